@@ -0,0 +1,265 @@
+// Package artifact resolves the binaries and archives plugins fetch onto the
+// nomad clients, from IPFS, arbitrary URLs, or files on the machine running
+// testlab, which testlab then serves itself.
+package artifact
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+// DefaultGateway is the IPFS gateway CIDs are fetched from, unless configured
+// otherwise.
+const DefaultGateway = "https://gateway.ipfs.io"
+
+// Options configure where the artifacts of a topology come from.
+type Options struct {
+	// Gateway is the IPFS gateway nomad clients fetch CIDs from. Defaults to
+	// DefaultGateway.
+	Gateway string
+	// IPFSAPI is the address of an IPFS API, e.g. http://127.0.0.1:5001,
+	// through which testlab fetches CIDs itself, serving them to the nomad
+	// clients. It requires Listen.
+	IPFSAPI string
+	// Listen is the address testlab's artifact server listens on, e.g.
+	// 10.0.0.5:8700. The server is only started if it is set.
+	Listen string
+	// URL is the URL nomad clients reach the artifact server at. Defaults to
+	// http://<Listen>.
+	URL string
+}
+
+// Validate checks that the options are well formed.
+func (o *Options) Validate() error {
+	if o.IPFSAPI != "" && o.Listen == "" {
+		return fmt.Errorf("the Artifacts IPFSAPI option requires Listen")
+	}
+	if o.URL != "" && o.Listen == "" {
+		return fmt.Errorf("the Artifacts URL option requires Listen")
+	}
+	return nil
+}
+
+// checksumTypes are the checksum types understood by nomad's artifact getter.
+var checksumTypes = map[string]struct{}{
+	"md5":    {},
+	"sha1":   {},
+	"sha256": {},
+	"sha512": {},
+}
+
+// Resolve returns the nomad artifact fetching the artifact described by the
+// plugin options into dest, relative to the task directory, or nil if the
+// options describe none. The artifact is one of:
+//
+//   - Build: a go package built from source by testlab, see buildSpec, served
+//     by its artifact server and verified against its SHA-256 checksum.
+//   - Path: a file on the machine running testlab, served likewise.
+//   - Fetch: a URL.
+//   - Cid: a CID, fetched from the configured IPFS gateway or API.
+//
+// in order of precedence. Checksum, e.g. "sha256:<hex>", verifies the
+// download, and Archive, e.g. "tar.gz" or false, overrides how it is unpacked.
+func Resolve(deployment *utils.DeploymentContext, options utils.NodeOptions, dest string) (*napi.TaskArtifact, error) {
+	config := deployment.Artifacts
+	if config == nil {
+		config = &utils.ArtifactConfig{}
+	}
+	getterOptions := make(map[string]string)
+
+	spec, err := parseBuild(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var source string
+	if spec != nil {
+		if config.ServerURL == "" {
+			return nil, fmt.Errorf("the Build option requires the artifact server, see the topology's Artifacts Listen option")
+		}
+		rel, err := build(config, spec)
+		if err != nil {
+			return nil, err
+		}
+		sum, err := checksum(filepath.Join(config.Dir, rel))
+		if err != nil {
+			return nil, err
+		}
+		source = serverURL(config, rel)
+		getterOptions["checksum"] = "sha256:" + sum
+	} else if path, ok := options.String("Path"); ok {
+		served, sum, err := serve(config, path)
+		if err != nil {
+			return nil, err
+		}
+		source = served
+		getterOptions["checksum"] = "sha256:" + sum
+	} else if fetch, ok := options.String("Fetch"); ok {
+		source = fetch
+	} else if cid, ok := options.String("Cid"); ok {
+		if source, err = resolveCid(config, cid); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	if want, ok := options.String("Checksum"); ok {
+		parts := strings.SplitN(want, ":", 2)
+		if _, known := checksumTypes[parts[0]]; !known || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid Checksum %q, expected <md5|sha1|sha256|sha512>:<hex>", want)
+		}
+		getterOptions["checksum"] = want
+	}
+	if archive, ok := options["Archive"]; ok {
+		switch a := archive.(type) {
+		case string:
+			getterOptions["archive"] = a
+		case bool:
+			if a {
+				return nil, fmt.Errorf("Archive must be false or an archive type, e.g. tar.gz")
+			}
+			getterOptions["archive"] = "false"
+		default:
+			return nil, fmt.Errorf("Archive must be false or an archive type, e.g. tar.gz")
+		}
+	}
+
+	artifact := &napi.TaskArtifact{
+		GetterSource: utils.StringPtr(source),
+		RelativeDest: utils.StringPtr(dest),
+	}
+	if len(getterOptions) > 0 {
+		artifact.GetterOptions = getterOptions
+	}
+	return artifact, nil
+}
+
+// resolveCid returns the URL nomad clients fetch the given CID from.
+func resolveCid(config *utils.ArtifactConfig, cid string) (string, error) {
+	if config.IPFSAPI == "" {
+		gateway := config.Gateway
+		if gateway == "" {
+			gateway = DefaultGateway
+		}
+		return fmt.Sprintf("%s/ipfs/%s", strings.TrimRight(gateway, "/"), cid), nil
+	}
+	if config.ServerURL == "" {
+		return "", fmt.Errorf("fetching CIDs through an IPFS API requires the artifact server")
+	}
+	rel := filepath.Join("ipfs", cid)
+	if _, err := os.Stat(filepath.Join(config.Dir, rel)); os.IsNotExist(err) {
+		if err := catCid(config, cid, rel); err != nil {
+			return "", fmt.Errorf("fetching %s from the IPFS API: %s", cid, err)
+		}
+	}
+	return serverURL(config, rel), nil
+}
+
+// ipfsClient reads CIDs from the IPFS API. Its timeout covers reading the
+// content, so that a stalled node cannot hang the topology's deployment.
+var ipfsClient = &http.Client{Timeout: 10 * time.Minute}
+
+// catCid stores the content of the given CID, read from the IPFS API, at the
+// given path within the served directory.
+func catCid(config *utils.ArtifactConfig, cid, rel string) error {
+	endpoint := fmt.Sprintf("%s/api/v0/cat?arg=%s", strings.TrimRight(config.IPFSAPI, "/"), url.QueryEscape(cid))
+	resp, err := ipfsClient.Post(endpoint, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return store(config, rel, resp.Body)
+}
+
+// serve copies the local file at the given path into the served directory,
+// under its SHA-256 checksum, returning its URL and checksum.
+func serve(config *utils.ArtifactConfig, path string) (string, string, error) {
+	if config.ServerURL == "" {
+		return "", "", fmt.Errorf("the Path option requires the artifact server, see the topology's Artifacts Listen option")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", "", err
+	}
+	if info.IsDir() {
+		return "", "", fmt.Errorf("artifact %s is a directory, archive it first", path)
+	}
+	sum, err := checksum(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	rel := filepath.Join(sum, filepath.Base(path))
+	if _, err := os.Stat(filepath.Join(config.Dir, rel)); os.IsNotExist(err) {
+		if err := store(config, rel, file); err != nil {
+			return "", "", err
+		}
+	}
+	return serverURL(config, rel), sum, nil
+}
+
+// checksum returns the hex encoded SHA-256 checksum of the given file.
+func checksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// store atomically writes the content of r at the given path within the served
+// directory.
+func store(config *utils.ArtifactConfig, rel string, r io.Reader) error {
+	path := filepath.Join(config.Dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".artifact")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func serverURL(config *utils.ArtifactConfig, rel string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimRight(config.ServerURL, "/"), filepath.ToSlash(rel))
+}
@@ -0,0 +1,314 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// The platform binaries are built for, unless the Build option says
+// otherwise.
+const (
+	DefaultGOOS   = "linux"
+	DefaultGOARCH = "amd64"
+)
+
+// buildSpec describes a go binary testlab builds from source.
+type buildSpec struct {
+	// Package is the package to build, relative to the working directory, or
+	// to the root of Repo if Repo or Ref is set.
+	Package string
+	// Repo is the git repository to check Ref out of. Defaults to the one
+	// containing the working directory.
+	Repo string
+	// Ref is the git ref to build. Defaults to HEAD when Repo is set.
+	Ref    string
+	GOOS   string
+	GOARCH string
+}
+
+// parseBuild reads the Build option, which is either a package path or an
+// object describing the build, returning nil if it is unset.
+func parseBuild(options utils.NodeOptions) (*buildSpec, error) {
+	spec := &buildSpec{GOOS: DefaultGOOS, GOARCH: DefaultGOARCH}
+	if pkg, ok := options.String("Build"); ok {
+		spec.Package = pkg
+		return spec, nil
+	}
+	obj, ok := options.Object("Build")
+	if !ok {
+		if _, set := options["Build"]; set {
+			return nil, fmt.Errorf("Build must be a package path or an object")
+		}
+		return nil, nil
+	}
+	var hasPackage bool
+	if spec.Package, hasPackage = obj.String("Package"); !hasPackage || spec.Package == "" {
+		return nil, fmt.Errorf("Build requires a Package")
+	}
+	spec.Repo, _ = obj.String("Repo")
+	spec.Ref, _ = obj.String("Ref")
+	if goos, ok := obj.String("GOOS"); ok {
+		spec.GOOS = goos
+	}
+	if goarch, ok := obj.String("GOARCH"); ok {
+		spec.GOARCH = goarch
+	}
+	return spec, nil
+}
+
+// builds memoizes the builds of the running process, keyed by the served
+// directory and the spec, so that task groups sharing a Build option only
+// resolve and hash their sources once.
+var builds = struct {
+	sync.Mutex
+	paths map[string]string
+}{paths: make(map[string]string)}
+
+// build cross-compiles the binary described by the spec into the served
+// directory, returning its path there. Builds are cached by the hash of their
+// sources: the commit resolved for git refs, or the files the build reads for
+// local packages. Repositories are only cloned on cache misses.
+func build(config *utils.ArtifactConfig, spec *buildSpec) (string, error) {
+	builds.Lock()
+	defer builds.Unlock()
+	key := fmt.Sprintf("%s\x00%+v", config.Dir, *spec)
+	if rel, ok := builds.paths[key]; ok {
+		return rel, nil
+	}
+
+	goVersion, err := output("", "go", "version")
+	if err != nil {
+		return "", err
+	}
+
+	var repo, source string
+	if spec.Repo == "" && spec.Ref == "" {
+		root, err := moduleRoot(spec.Package)
+		if err != nil {
+			return "", err
+		}
+		files, err := buildInputs(spec, root)
+		if err != nil {
+			return "", err
+		}
+		if source, err = hashFiles(root, files); err != nil {
+			return "", err
+		}
+	} else {
+		repo = spec.Repo
+		if repo == "" {
+			if repo, err = output("", "git", "rev-parse", "--show-toplevel"); err != nil {
+				return "", err
+			}
+		}
+		if source, err = resolveCommit(repo, spec.Ref); err != nil {
+			return "", err
+		}
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{source, spec.Package, spec.GOOS, spec.GOARCH, goVersion}, "\n")))
+	rel := filepath.Join("builds", hex.EncodeToString(sum[:]), path.Base(filepath.ToSlash(spec.Package)))
+	target, err := filepath.Abs(filepath.Join(config.Dir, rel))
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(target); err == nil {
+		logrus.Infof("using cached build of %s", spec.Package)
+		builds.paths[key] = rel
+		return rel, nil
+	}
+
+	srcDir := ""
+	if repo != "" {
+		if srcDir, err = ioutil.TempDir("", "testlab-build"); err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(srcDir)
+		if _, err := output("", "git", "clone", "--quiet", repo, srcDir); err != nil {
+			return "", err
+		}
+		if _, err := output(srcDir, "git", "checkout", "--quiet", source); err != nil {
+			return "", err
+		}
+	}
+
+	logrus.Infof("building %s for %s/%s", spec.Package, spec.GOOS, spec.GOARCH)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	tmp := target + ".tmp"
+	defer os.Remove(tmp)
+	cmd := exec.Command("go", "build", "-o", tmp, spec.Package)
+	cmd.Dir = srcDir
+	cmd.Env = buildEnv(spec)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("building %s: %s\n%s", spec.Package, err, out)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return "", err
+	}
+	builds.paths[key] = rel
+	return rel, nil
+}
+
+// commitRegexp matches full git commit hashes.
+var commitRegexp = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// resolveCommit returns the commit the given ref, HEAD if empty, points to in
+// the given repository, without cloning it. Local repositories are queried
+// with rev-parse, and remote ones with ls-remote.
+func resolveCommit(repo, ref string) (string, error) {
+	if ref == "" {
+		ref = "HEAD"
+	}
+	if commitRegexp.MatchString(ref) {
+		return ref, nil
+	}
+	if info, err := os.Stat(repo); err == nil && info.IsDir() {
+		return output(repo, "git", "rev-parse", "--verify", ref+"^{commit}")
+	}
+	refs, err := output("", "git", "ls-remote", repo, ref, ref+"^{}")
+	if err != nil {
+		return "", err
+	}
+	// Annotated tags are listed twice, the second time peeled to the commit
+	// they point to.
+	var commit string
+	for _, line := range strings.Split(refs, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if commit == "" || strings.HasSuffix(fields[1], "^{}") {
+			commit = fields[0]
+		}
+	}
+	if commit == "" {
+		return "", fmt.Errorf("no ref %s in %s, Ref must be a branch, a tag or a full commit hash", ref, repo)
+	}
+	return commit, nil
+}
+
+// moduleRoot returns the root of the go module containing the given package
+// directory, or the directory itself if it is not part of a module.
+func moduleRoot(pkg string) (string, error) {
+	dir, err := filepath.Abs(pkg)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !info.IsDir() {
+		return "", fmt.Errorf("Build package %s is not a directory", pkg)
+	}
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d, nil
+		}
+		if filepath.Dir(d) == d {
+			return dir, nil
+		}
+	}
+}
+
+// buildEnv is the environment the spec's binary is built in.
+func buildEnv(spec *buildSpec) []string {
+	return append(os.Environ(), "GOOS="+spec.GOOS, "GOARCH="+spec.GOARCH, "CGO_ENABLED=0")
+}
+
+// buildInputs lists the source files building the spec's local package reads
+// for its platform: those of every package outside the standard library it
+// depends on, and the go.mod and go.sum files of its module.
+func buildInputs(spec *buildSpec, root string) ([]string, error) {
+	cmd := exec.Command("go", "list", "-deps", "-json", spec.Package)
+	cmd.Env = buildEnv(spec)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing the dependencies of %s: %s: %s", spec.Package, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var files []string
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for {
+		var pkg struct {
+			Dir                                   string
+			Standard                              bool
+			GoFiles, CgoFiles, SFiles, EmbedFiles []string
+		}
+		if err := dec.Decode(&pkg); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if pkg.Standard {
+			continue
+		}
+		for _, names := range [][]string{pkg.GoFiles, pkg.CgoFiles, pkg.SFiles, pkg.EmbedFiles} {
+			for _, name := range names {
+				files = append(files, filepath.Join(pkg.Dir, name))
+			}
+		}
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		if _, err := os.Stat(filepath.Join(root, name)); err == nil {
+			files = append(files, filepath.Join(root, name))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// hashFiles hashes the names, relative to root, and contents of the given
+// files.
+func hashFiles(root string, files []string) (string, error) {
+	hash := sha256.New()
+	for _, p := range files {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return "", err
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s\x00", filepath.ToSlash(rel))
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// output runs the given command in dir, returning its trimmed standard output.
+func output(dir, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %s: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,56 @@
+package artifact
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server serves a directory of artifacts to the nomad clients over HTTP.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+}
+
+// Listen starts serving the given directory on the given address.
+func Listen(dir, addr string) (*Server, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: listener,
+		server:   &http.Server{Handler: http.FileServer(http.Dir(dir))},
+	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("serving artifacts: %s", err)
+		}
+	}()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// URL returns the URL of the server, if it listens on a specific address.
+func (s *Server) URL() (string, error) {
+	addr, ok := s.listener.Addr().(*net.TCPAddr)
+	if !ok || addr.IP.IsUnspecified() {
+		return "", fmt.Errorf("the artifact server listens on every interface, set the Artifacts URL option to the address nomad clients reach it at")
+	}
+	return fmt.Sprintf("http://%s", addr), nil
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,421 @@
+// Package chaos injects faults into the allocations of a running testlab
+// topology, recording every fault so it can be lined up with metrics.
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/network"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Fault types understood by the Injector.
+const (
+	// Kill sends SIGKILL to the deployment's main task, leaving nomad's
+	// restart policy to bring it back.
+	Kill = "kill"
+	// Pause sends SIGSTOP to the deployment's main task, followed by SIGCONT
+	// once the fault's Duration has elapsed.
+	Pause = "pause"
+	// Partition splits the fault's Islands from one another, healing the
+	// network once the fault's Duration has elapsed.
+	Partition = "partition"
+	// Disk saturates the disk of the deployment's allocations with writes,
+	// through a disk sidecar, until the fault's Duration has elapsed.
+	Disk = "disk"
+)
+
+// Fault describes a failure to inject into a deployment.
+type Fault struct {
+	// Type is one of the fault types defined in this package.
+	Type string
+	// Deployment is the name of the deployment to inject the fault into.
+	Deployment string
+	// Percent is the percentage of the deployment's running allocations
+	// affected by the fault. At least one allocation is always affected.
+	Percent float64
+	// At is the time since the start of the run at which to inject the fault,
+	// e.g. "5m".
+	At string
+	// Duration is how long the fault lasts, for fault types that are undone.
+	Duration string
+	// Islands are the sets of deployment names or peer IDs to isolate from
+	// one another, for partition faults.
+	Islands [][]string
+}
+
+// Validate checks that the fault is well formed.
+func (f *Fault) Validate() error {
+	switch f.Type {
+	case Kill:
+	case Pause, Disk:
+		if f.Duration == "" {
+			return fmt.Errorf("%s faults require a Duration", f.Type)
+		}
+	case Partition:
+		if len(f.Islands) < 2 {
+			return fmt.Errorf("%s faults require at least 2 Islands", f.Type)
+		}
+		if f.Duration == "" {
+			return fmt.Errorf("%s faults require a Duration", f.Type)
+		}
+	default:
+		return fmt.Errorf("unknown fault type %q", f.Type)
+	}
+	if f.Type != Partition {
+		if f.Deployment == "" {
+			return fmt.Errorf("%s fault requires a Deployment", f.Type)
+		}
+		if f.Percent <= 0 || f.Percent > 100 {
+			return fmt.Errorf("%s fault on %s: Percent must be in (0, 100], got %f", f.Type, f.Deployment, f.Percent)
+		}
+	}
+	if _, err := f.at(); err != nil {
+		return fmt.Errorf("%s fault on %s: invalid At: %s", f.Type, f.target(), err)
+	}
+	if _, err := f.duration(); err != nil {
+		return fmt.Errorf("%s fault on %s: invalid Duration: %s", f.Type, f.target(), err)
+	}
+	return nil
+}
+
+// target describes what the fault applies to in errors: its deployment, or
+// its islands for partition faults.
+func (f *Fault) target() string {
+	if f.Type != Partition {
+		return f.Deployment
+	}
+	islands := make([]string, len(f.Islands))
+	for i, island := range f.Islands {
+		islands[i] = "[" + strings.Join(island, ", ") + "]"
+	}
+	return strings.Join(islands, " / ")
+}
+
+func (f *Fault) at() (time.Duration, error) {
+	if f.At == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(f.At)
+}
+
+func (f *Fault) duration() (time.Duration, error) {
+	if f.Duration == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(f.Duration)
+}
+
+// Record is an entry in the log of injected faults.
+type Record struct {
+	Type        string
+	Deployment  string     `json:",omitempty"`
+	Islands     [][]string `json:",omitempty"`
+	Allocations []string   `json:",omitempty"`
+	Start       time.Time
+	End         time.Time `json:",omitempty"`
+	Error       string    `json:",omitempty"`
+}
+
+// Injector injects faults into the deployments of a topology through nomad.
+type Injector struct {
+	nomad       *napi.Client
+	consul      *capi.Client
+	partitioner *network.Partitioner
+	topology    string
+	runID       string
+
+	lk      sync.Mutex
+	records []*Record
+}
+
+// NewInjector creates an Injector for the given run of the named topology.
+// Faults are recorded in consul's KV store, under the run's "faults" prefix.
+func NewInjector(nomad *napi.Client, consul *capi.Client, topology, runID string) *Injector {
+	return &Injector{
+		nomad:       nomad,
+		consul:      consul,
+		partitioner: network.NewPartitioner(consul, runID),
+		topology:    topology,
+		runID:       runID,
+	}
+}
+
+// Records returns every fault injected so far.
+func (i *Injector) Records() []*Record {
+	i.lk.Lock()
+	defer i.lk.Unlock()
+	return append([]*Record{}, i.records...)
+}
+
+// Run injects each fault at its scheduled time, relative to start, blocking
+// until all of them have completed or the context is cancelled.
+func (i *Injector) Run(ctx context.Context, start time.Time, faults []*Fault) error {
+	for _, fault := range faults {
+		if err := fault.Validate(); err != nil {
+			return err
+		}
+	}
+
+	var wg sync.WaitGroup
+	errch := make(chan error, len(faults))
+	wg.Add(len(faults))
+	for _, fault := range faults {
+		go func(fault *Fault) {
+			defer wg.Done()
+			at, _ := fault.at()
+			select {
+			case <-time.After(time.Until(start.Add(at))):
+			case <-ctx.Done():
+				return
+			}
+			if err := i.Inject(ctx, fault); err != nil {
+				errch <- err
+			}
+		}(fault)
+	}
+	wg.Wait()
+	close(errch)
+
+	if err, ok := <-errch; ok {
+		return err
+	}
+	return ctx.Err()
+}
+
+// Inject injects a single fault immediately, blocking until it is undone.
+func (i *Injector) Inject(ctx context.Context, fault *Fault) error {
+	if err := fault.Validate(); err != nil {
+		return err
+	}
+	duration, _ := fault.duration()
+	switch fault.Type {
+	case Kill:
+		_, err := i.Kill(fault.Deployment, fault.Percent)
+		return err
+	case Pause:
+		_, err := i.Pause(ctx, fault.Deployment, fault.Percent, duration)
+		return err
+	case Partition:
+		_, err := i.Partition(ctx, duration, fault.Islands...)
+		return err
+	case Disk:
+		_, err := i.Disk(ctx, fault.Deployment, fault.Percent, duration)
+		return err
+	}
+	return nil
+}
+
+// Partition isolates the given islands of deployment names or peer IDs from
+// one another, healing the network after the given duration or when the
+// context is cancelled. The affected deployments must have been scheduled
+// with partitions enabled.
+func (i *Injector) Partition(ctx context.Context, duration time.Duration, islands ...[]string) (*Record, error) {
+	record := &Record{
+		Type:    Partition,
+		Islands: islands,
+		Start:   time.Now(),
+	}
+	if err := i.partitioner.Partition(islands...); err != nil {
+		i.record(record, err)
+		return record, err
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+	err := i.partitioner.Heal()
+	record.End = time.Now()
+	i.record(record, err)
+	return record, err
+}
+
+// Kill sends SIGKILL to percent of the deployment's running allocations.
+func (i *Injector) Kill(deployment string, percent float64) (*Record, error) {
+	record := &Record{
+		Type:       Kill,
+		Deployment: deployment,
+		Start:      time.Now(),
+	}
+	err := i.signal(record, percent, "SIGKILL")
+	i.record(record, err)
+	return record, err
+}
+
+// Pause sends SIGSTOP to percent of the deployment's running allocations,
+// resuming them with SIGCONT after the given duration or when the context is
+// cancelled.
+func (i *Injector) Pause(ctx context.Context, deployment string, percent float64, duration time.Duration) (*Record, error) {
+	record := &Record{
+		Type:       Pause,
+		Deployment: deployment,
+		Start:      time.Now(),
+	}
+	allocs, err := i.allocations(deployment, percent)
+	if err == nil {
+		err = i.signalAll(record, allocs, "SIGSTOP")
+	}
+	if err != nil {
+		// Resume whatever was stopped before the failure.
+		stopped := make([]*target, 0, len(record.Allocations))
+		for _, t := range allocs {
+			for _, id := range record.Allocations {
+				if t.alloc.ID == id {
+					stopped = append(stopped, t)
+				}
+			}
+		}
+		if cerr := i.signalAll(&Record{}, stopped, "SIGCONT"); cerr != nil {
+			err = fmt.Errorf("%s; resuming: %s", err, cerr)
+		}
+		record.End = time.Now()
+		i.record(record, err)
+		return record, err
+	}
+
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+	}
+	err = i.signalAll(&Record{}, allocs, "SIGCONT")
+	record.End = time.Now()
+	i.record(record, err)
+	return record, err
+}
+
+func (i *Injector) signal(record *Record, percent float64, signal string) error {
+	allocs, err := i.allocations(record.Deployment, percent)
+	if err != nil {
+		return err
+	}
+	return i.signalAll(record, allocs, signal)
+}
+
+// signalAll sends the signal to every target, recording those signalled
+// successfully. Every target is attempted even if some fail.
+func (i *Injector) signalAll(record *Record, allocs []*target, signal string) error {
+	var errs []string
+	for _, t := range allocs {
+		q := &napi.QueryOptions{Region: t.region}
+		if err := i.nomad.Allocations().Signal(t.alloc, q, t.task, signal); err != nil {
+			errs = append(errs, fmt.Sprintf("sending %s to allocation %s: %s", signal, t.alloc.ID, err))
+			continue
+		}
+		record.Allocations = append(record.Allocations, t.alloc.ID)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (i *Injector) record(record *Record, err error) {
+	if err != nil {
+		record.Error = err.Error()
+		logrus.Errorf("%s fault on %s failed: %s", record.Type, record.Deployment, err)
+	} else if record.Type == Partition {
+		logrus.Infof("%s fault isolated %d islands", record.Type, len(record.Islands))
+	} else {
+		logrus.Infof("%s fault on %s affected %d allocations", record.Type, record.Deployment, len(record.Allocations))
+	}
+
+	i.lk.Lock()
+	i.records = append(i.records, record)
+	i.lk.Unlock()
+
+	if i.consul == nil {
+		return
+	}
+	bs, err := json.Marshal(record)
+	if err != nil {
+		logrus.Errorf("encoding fault record: %s", err)
+		return
+	}
+	kv := &capi.KVPair{
+		Key:   utils.RunKey(i.runID, "faults", fmt.Sprintf("%d-%s", record.Start.UnixNano(), record.Type)),
+		Value: bs,
+	}
+	if _, err := i.consul.KV().Put(kv, nil); err != nil {
+		logrus.Errorf("recording fault: %s", err)
+	}
+}
+
+type target struct {
+	alloc  *napi.Allocation
+	task   string
+	region string
+}
+
+// allocations picks percent of the deployment's running allocations at
+// random, across every region, along with the name of the task to signal.
+func (i *Injector) allocations(deployment string, percent float64) ([]*target, error) {
+	regions, err := i.nomad.Regions().List()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []*target
+	prefix := fmt.Sprintf("%s_phase_", i.topology)
+	for _, region := range regions {
+		q := &napi.QueryOptions{Region: region}
+		jobs, _, err := i.nomad.Jobs().List(&napi.QueryOptions{Region: region, Prefix: prefix})
+		if err != nil {
+			return nil, err
+		}
+		for _, stub := range jobs {
+			if !strings.HasPrefix(stub.ID, prefix) {
+				continue
+			}
+			job, _, err := i.nomad.Jobs().Info(stub.ID, q)
+			if err != nil {
+				return nil, err
+			}
+			tasks := make(map[string]string)
+			for _, group := range job.TaskGroups {
+				// Groups also run sidecars, so only the task recorded as the
+				// plugin's main task is signalled.
+				if group.Meta[utils.DeploymentMetaKey] == deployment && group.Meta[utils.TaskMetaKey] != "" {
+					tasks[*group.Name] = group.Meta[utils.TaskMetaKey]
+				}
+			}
+			if len(tasks) == 0 {
+				continue
+			}
+			allocs, _, err := i.nomad.Jobs().Allocations(stub.ID, false, q)
+			if err != nil {
+				return nil, err
+			}
+			for _, alloc := range allocs {
+				task, ok := tasks[alloc.TaskGroup]
+				if !ok || alloc.ClientStatus != "running" {
+					continue
+				}
+				info, _, err := i.nomad.Allocations().Info(alloc.ID, q)
+				if err != nil {
+					return nil, err
+				}
+				candidates = append(candidates, &target{alloc: info, task: task, region: region})
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no running allocations found for deployment %s", deployment)
+	}
+
+	n := int(math.Ceil(float64(len(candidates)) * percent / 100))
+	rand.Shuffle(len(candidates), func(a, b int) {
+		candidates[a], candidates[b] = candidates[b], candidates[a]
+	})
+	return candidates[:n], nil
+}
@@ -0,0 +1,144 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+// DiskTaskName is the name of the sidecar task added to the task groups of
+// deployments that disk faults can be injected into.
+const DiskTaskName = "disk"
+
+// DiskPrefix is the consul KV prefix, within a run's namespace, instructing
+// disk sidecars to degrade their allocation's disk. Keys are of the form
+// "testlab/<run id>/<prefix>/<allocation id>", holding the Unix time at which
+// the fault ends.
+const DiskPrefix = "disk"
+
+// DiskTask generates the disk sidecar task. While its allocation's key is set
+// under DiskPrefix, the sidecar saturates the allocation's disk with direct
+// writes to the shared allocation directory, until the key is deleted or the
+// deadline it holds passes.
+func DiskTask() *napi.Task {
+	task := napi.NewTask(DiskTaskName, "raw_exec")
+	state := diskTemplate
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &state,
+		DestPath:     utils.StringPtr("local/disk.state"),
+		ChangeMode:   utils.StringPtr("signal"),
+		ChangeSignal: utils.StringPtr("SIGHUP"),
+	})
+	script := diskScript
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &script,
+		DestPath:     utils.StringPtr("local/disk.sh"),
+	})
+	task.SetConfig("command", "/bin/sh")
+	task.SetConfig("args", []string{"local/disk.sh"})
+
+	res := napi.DefaultResources()
+	cpu := 50
+	res.CPU = &cpu
+	memory := 32
+	res.MemoryMB = &memory
+	task.Require(res)
+	return task
+}
+
+var diskTemplate = fmt.Sprintf(`{{ keyOrDefault (printf "%s/%%s/%s/%%s" (env %q) (env "NOMAD_ALLOC_ID")) "" }}`, utils.KVPrefix, DiskPrefix, utils.RunIDEnvName)
+
+const diskScript = `#!/bin/sh
+FILE="$NOMAD_ALLOC_DIR/testlab-disk-fault"
+PID=""
+
+stop_io() {
+  [ -n "$PID" ] && kill "$PID" 2>/dev/null && wait "$PID"
+  PID=""
+  rm -f "$FILE"
+}
+
+# apply writes to the allocation's disk until the deadline rendered into
+# local/disk.state, if any.
+apply() {
+  stop_io
+  UNTIL=$(cat local/disk.state)
+  [ -z "$UNTIL" ] && return
+  (
+    trap 'kill "$DD" 2>/dev/null; exit 0' TERM
+    while [ "$(date +%s)" -lt "$UNTIL" ]; do
+      dd if=/dev/zero of="$FILE" bs=1M count=256 oflag=direct conv=fsync 2>/dev/null &
+      DD=$!
+      wait "$DD"
+    done
+  ) &
+  PID=$!
+}
+
+cleanup() {
+  stop_io
+  exit 0
+}
+trap apply HUP
+trap cleanup INT TERM
+apply
+
+while true; do
+  sleep 3600 &
+  wait $!
+done
+`
+
+// Disk saturates the disks of percent of the deployment's running allocations
+// for the given duration, or until the context is cancelled. The deployment
+// must have been scheduled with disk faults enabled.
+func (i *Injector) Disk(ctx context.Context, deployment string, percent float64, duration time.Duration) (*Record, error) {
+	record := &Record{
+		Type:       Disk,
+		Deployment: deployment,
+		Start:      time.Now(),
+	}
+	if i.consul == nil {
+		err := fmt.Errorf("disk faults require a consul client")
+		i.record(record, err)
+		return record, err
+	}
+	allocs, err := i.allocations(deployment, percent)
+	if err != nil {
+		i.record(record, err)
+		return record, err
+	}
+
+	// The sidecars stop on their own once the deadline passes, should the
+	// keys outlive the injector.
+	until := strconv.FormatInt(record.Start.Add(duration).Unix(), 10)
+	kv := i.consul.KV()
+	for _, t := range allocs {
+		pair := &capi.KVPair{Key: utils.RunKey(i.runID, DiskPrefix, t.alloc.ID), Value: []byte(until)}
+		if _, err = kv.Put(pair, nil); err != nil {
+			err = fmt.Errorf("degrading the disk of allocation %s: %s", t.alloc.ID, err)
+			break
+		}
+		record.Allocations = append(record.Allocations, t.alloc.ID)
+	}
+
+	if err == nil {
+		select {
+		case <-time.After(duration):
+		case <-ctx.Done():
+		}
+	}
+	for _, id := range record.Allocations {
+		if _, derr := kv.Delete(utils.RunKey(i.runID, DiskPrefix, id), nil); derr != nil && err == nil {
+			err = fmt.Errorf("restoring the disk of allocation %s: %s", id, derr)
+		}
+	}
+	record.End = time.Now()
+	i.record(record, err)
+	return record, err
+}
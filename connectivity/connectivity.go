@@ -0,0 +1,313 @@
+// Package connectivity wires the peers of a running testlab topology into a
+// chosen initial graph, recording the intended graph so that it can be
+// compared against the observed one.
+package connectivity
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Graph types understood by Spec.
+const (
+	// Mesh connects every peer to every other peer.
+	Mesh = "mesh"
+	// Ring connects each peer to the next one, and the last to the first.
+	Ring = "ring"
+	// KRegular connects each peer to K others, chosen at random.
+	KRegular = "k-regular"
+	// ErdosRenyi connects each pair of peers with probability P.
+	ErdosRenyi = "erdos-renyi"
+	// ScaleFree grows a Barabási–Albert graph, attaching each peer to M peers
+	// already in the graph, preferring those with a higher degree.
+	ScaleFree = "scale-free"
+	// Edges connects the pairs of peers listed in Edges.
+	Edges = "edges"
+)
+
+// Spec describes the graph to connect the peers of a topology into. Peers are
+// named "<deployment>/<index>", where peers within a deployment are indexed in
+// the order of their peer IDs, so that names are stable across runs when
+// identities are fixed.
+type Spec struct {
+	// Type is one of the graph types defined in this package.
+	Type string
+	// Deployments are the deployments whose peers make up the graph, in
+	// order. They must expose a p2pd service. Defaults to every p2pd
+	// deployment of the topology.
+	Deployments []string
+	// K is the degree of each peer of a k-regular graph.
+	K int
+	// P is the probability of each edge of an Erdős–Rényi graph.
+	P float64
+	// M is the number of edges each peer adds to a scale-free graph.
+	M int
+	// Seed seeds random graphs. The same seed and peers yield the same graph.
+	Seed int64
+	// Edges lists the pairs of peer names to connect, for edge list graphs.
+	Edges [][]string
+	// Parallelism is the number of peers dialing at once. Defaults to 16.
+	Parallelism int
+}
+
+// Validate checks that the spec is well formed.
+func (s *Spec) Validate() error {
+	switch s.Type {
+	case Mesh, Ring:
+	case KRegular:
+		if s.K < 1 {
+			return fmt.Errorf("%s graphs require K >= 1", s.Type)
+		}
+	case ErdosRenyi:
+		if s.P <= 0 || s.P > 1 {
+			return fmt.Errorf("%s graphs require 0 < P <= 1", s.Type)
+		}
+	case ScaleFree:
+		if s.M < 1 {
+			return fmt.Errorf("%s graphs require M >= 1", s.Type)
+		}
+	case Edges:
+		if len(s.Edges) == 0 {
+			return fmt.Errorf("%s graphs require Edges", s.Type)
+		}
+		for _, edge := range s.Edges {
+			if len(edge) != 2 {
+				return fmt.Errorf("edges must be pairs of peer names, got %v", edge)
+			}
+			for _, name := range edge {
+				if _, _, err := parseName(name); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown connectivity type %q", s.Type)
+	}
+	if s.Parallelism < 0 {
+		return fmt.Errorf("connectivity Parallelism must not be negative")
+	}
+	return nil
+}
+
+// Node is a peer of a graph.
+type Node struct {
+	// Name is the peer's name, "<deployment>/<index>".
+	Name string
+	// PeerID is the peer's ID.
+	PeerID string
+}
+
+// Graph is an undirected graph of peers.
+type Graph struct {
+	Nodes []*Node
+	// Edges are pairs of indices into Nodes, lowest first, sorted.
+	Edges [][2]int
+}
+
+// Diff returns the edges of g missing from other, and those of other missing
+// from g, matching nodes by peer ID.
+func (g *Graph) Diff(other *Graph) (missing, extra [][2]string) {
+	edgeSet := func(graph *Graph) map[[2]string]struct{} {
+		set := make(map[[2]string]struct{}, len(graph.Edges))
+		for _, e := range graph.Edges {
+			a, b := graph.Nodes[e[0]].PeerID, graph.Nodes[e[1]].PeerID
+			if b < a {
+				a, b = b, a
+			}
+			set[[2]string{a, b}] = struct{}{}
+		}
+		return set
+	}
+	mine, theirs := edgeSet(g), edgeSet(other)
+	for e := range mine {
+		if _, ok := theirs[e]; !ok {
+			missing = append(missing, e)
+		}
+	}
+	for e := range theirs {
+		if _, ok := mine[e]; !ok {
+			extra = append(extra, e)
+		}
+	}
+	return missing, extra
+}
+
+// edges generates the edges of the spec's graph between n peers, whose names
+// are given for edge list graphs.
+func (s *Spec) edges(names []string) ([][2]int, error) {
+	n := len(names)
+	rng := rand.New(rand.NewSource(s.Seed))
+	set := make(map[[2]int]struct{})
+	add := func(a, b int) {
+		if a == b {
+			return
+		}
+		if b < a {
+			a, b = b, a
+		}
+		set[[2]int{a, b}] = struct{}{}
+	}
+
+	switch s.Type {
+	case Mesh:
+		for a := 0; a < n; a++ {
+			for b := a + 1; b < n; b++ {
+				add(a, b)
+			}
+		}
+	case Ring:
+		for a := 0; a < n && n > 1; a++ {
+			add(a, (a+1)%n)
+		}
+	case KRegular:
+		if err := kRegular(n, s.K, rng, add, set); err != nil {
+			return nil, err
+		}
+	case ErdosRenyi:
+		for a := 0; a < n; a++ {
+			for b := a + 1; b < n; b++ {
+				if rng.Float64() < s.P {
+					add(a, b)
+				}
+			}
+		}
+	case ScaleFree:
+		if n <= s.M {
+			return nil, fmt.Errorf("%s graphs with M = %d require more than %d peers, got %d", s.Type, s.M, s.M, n)
+		}
+		// Start from a complete graph of M+1 peers. Each endpoint of an edge
+		// appears once in targets, so that sampling from it is proportional to
+		// degree.
+		var targets []int
+		for a := 0; a <= s.M; a++ {
+			for b := a + 1; b <= s.M; b++ {
+				add(a, b)
+				targets = append(targets, a, b)
+			}
+		}
+		for a := s.M + 1; a < n; a++ {
+			// Chosen peers are kept in order, so that targets, and thus the
+			// graph, only depend on the seed.
+			chosen := make(map[int]struct{}, s.M)
+			order := make([]int, 0, s.M)
+			for len(order) < s.M {
+				b := targets[rng.Intn(len(targets))]
+				if _, ok := chosen[b]; !ok {
+					chosen[b] = struct{}{}
+					order = append(order, b)
+				}
+			}
+			for _, b := range order {
+				add(a, b)
+				targets = append(targets, a, b)
+			}
+		}
+	case Edges:
+		index := make(map[string]int, n)
+		for i, name := range names {
+			index[name] = i
+		}
+		for _, edge := range s.Edges {
+			a, ok := index[edge[0]]
+			if !ok {
+				return nil, fmt.Errorf("unknown peer %s", edge[0])
+			}
+			b, ok := index[edge[1]]
+			if !ok {
+				return nil, fmt.Errorf("unknown peer %s", edge[1])
+			}
+			add(a, b)
+		}
+	}
+
+	edges := make([][2]int, 0, len(set))
+	for e := range set {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	return edges, nil
+}
+
+// kRegular generates a random k-regular graph between n peers, starting from
+// a ring lattice and randomizing it with degree preserving edge swaps.
+func kRegular(n, k int, rng *rand.Rand, add func(a, b int), set map[[2]int]struct{}) error {
+	if k >= n {
+		return fmt.Errorf("%s graphs with K = %d require more than %d peers, got %d", KRegular, k, k, n)
+	}
+	if n*k%2 != 0 {
+		return fmt.Errorf("%s graphs require an even number of edge endpoints, got %d peers of degree %d", KRegular, n, k)
+	}
+	for a := 0; a < n; a++ {
+		for d := 1; d <= k/2; d++ {
+			add(a, (a+d)%n)
+		}
+		// With an odd degree, n is even, and each peer is also connected to
+		// the opposite one.
+		if k%2 == 1 {
+			add(a, (a+n/2)%n)
+		}
+	}
+
+	key := func(a, b int) [2]int {
+		if b < a {
+			a, b = b, a
+		}
+		return [2]int{a, b}
+	}
+	edges := make([][2]int, 0, len(set))
+	for e := range set {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+	// Swap the endpoints of random pairs of edges, a-b and c-d becoming a-d
+	// and c-b, whenever that creates neither loops nor duplicate edges.
+	for i := 0; i < 10*len(edges); i++ {
+		x, y := rng.Intn(len(edges)), rng.Intn(len(edges))
+		a, b := edges[x][0], edges[x][1]
+		c, d := edges[y][0], edges[y][1]
+		if a == d || c == b {
+			continue
+		}
+		if _, ok := set[key(a, d)]; ok {
+			continue
+		}
+		if _, ok := set[key(c, b)]; ok {
+			continue
+		}
+		delete(set, edges[x])
+		delete(set, edges[y])
+		edges[x], edges[y] = key(a, d), key(c, b)
+		set[edges[x]] = struct{}{}
+		set[edges[y]] = struct{}{}
+	}
+	return nil
+}
+
+func nodeName(deployment string, index int) string {
+	return fmt.Sprintf("%s/%d", deployment, index)
+}
+
+func parseName(name string) (string, int, error) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", 0, fmt.Errorf("invalid peer name %q, expected <deployment>/<index>", name)
+	}
+	index, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid peer name %q, expected <deployment>/<index>", name)
+	}
+	return name[:i], index, nil
+}
@@ -0,0 +1,240 @@
+package connectivity
+
+import (
+	"reflect"
+	"testing"
+
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// peerNames names n peers of a single deployment.
+func peerNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = nodeName("peers", i)
+	}
+	return names
+}
+
+// degrees checks that edges form a simple graph between n peers, lowest index
+// first, and returns the degree of each peer.
+func degrees(t *testing.T, n int, edges [][2]int) []int {
+	degree := make([]int, n)
+	seen := make(map[[2]int]struct{}, len(edges))
+	for _, e := range edges {
+		if e[0] >= e[1] {
+			t.Fatalf("edge %v is a loop or not ordered lowest first", e)
+		}
+		if e[0] < 0 || e[1] >= n {
+			t.Fatalf("edge %v is out of range for %d peers", e, n)
+		}
+		if _, ok := seen[e]; ok {
+			t.Fatalf("duplicate edge %v", e)
+		}
+		seen[e] = struct{}{}
+		degree[e[0]]++
+		degree[e[1]]++
+	}
+	return degree
+}
+
+// connected reports whether every peer can be reached from the first.
+func connected(n int, edges [][2]int) bool {
+	adjacent := make([][]int, n)
+	for _, e := range edges {
+		adjacent[e[0]] = append(adjacent[e[0]], e[1])
+		adjacent[e[1]] = append(adjacent[e[1]], e[0])
+	}
+	visited := make([]bool, n)
+	visited[0] = true
+	queue, reached := []int{0}, 1
+	for len(queue) > 0 {
+		a := queue[0]
+		queue = queue[1:]
+		for _, b := range adjacent[a] {
+			if !visited[b] {
+				visited[b] = true
+				reached++
+				queue = append(queue, b)
+			}
+		}
+	}
+	return reached == n
+}
+
+func TestKRegular(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		n, k  int
+		fails bool
+	}{
+		{name: "ring", n: 5, k: 2},
+		{name: "even degree", n: 20, k: 4},
+		{name: "odd degree", n: 20, k: 3},
+		{name: "perfect matching", n: 10, k: 1},
+		{name: "complete", n: 6, k: 5},
+		{name: "degree too high", n: 4, k: 4, fails: true},
+		{name: "odd endpoints", n: 5, k: 3, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for seed := int64(0); seed < 5; seed++ {
+				spec := &Spec{Type: KRegular, K: tc.k, Seed: seed}
+				edges, err := spec.edges(peerNames(tc.n))
+				if tc.fails {
+					if err == nil {
+						t.Fatalf("expected an error, got %d edges", len(edges))
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(edges) != tc.n*tc.k/2 {
+					t.Fatalf("seed %d: expected %d edges, got %d", seed, tc.n*tc.k/2, len(edges))
+				}
+				for peer, degree := range degrees(t, tc.n, edges) {
+					if degree != tc.k {
+						t.Fatalf("seed %d: peer %d has degree %d, expected %d", seed, peer, degree, tc.k)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestScaleFree(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		n, m  int
+		fails bool
+	}{
+		{name: "tree", n: 20, m: 1},
+		{name: "m 2", n: 50, m: 2},
+		{name: "m 3", n: 50, m: 3},
+		{name: "seed graph only", n: 4, m: 3},
+		{name: "too few peers", n: 3, m: 3, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for seed := int64(0); seed < 5; seed++ {
+				spec := &Spec{Type: ScaleFree, M: tc.m, Seed: seed}
+				edges, err := spec.edges(peerNames(tc.n))
+				if tc.fails {
+					if err == nil {
+						t.Fatalf("expected an error, got %d edges", len(edges))
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				// A complete graph of M+1 peers, and M edges per further peer.
+				expected := tc.m*(tc.m+1)/2 + (tc.n-tc.m-1)*tc.m
+				if len(edges) != expected {
+					t.Fatalf("seed %d: expected %d edges, got %d", seed, expected, len(edges))
+				}
+				for peer, degree := range degrees(t, tc.n, edges) {
+					if degree < tc.m {
+						t.Fatalf("seed %d: peer %d has degree %d, expected at least %d", seed, peer, degree, tc.m)
+					}
+				}
+				if !connected(tc.n, edges) {
+					t.Fatalf("seed %d: graph is not connected", seed)
+				}
+			}
+		})
+	}
+}
+
+func TestErdosRenyi(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		n    int
+		p    float64
+		// The bounds of the number of edges.
+		min, max int
+	}{
+		{name: "complete", n: 10, p: 1, min: 45, max: 45},
+		{name: "single peer", n: 1, p: 1, min: 0, max: 0},
+		{name: "sparse", n: 100, p: 0.05, min: 150, max: 350},
+		{name: "dense", n: 100, p: 0.5, min: 2200, max: 2750},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for seed := int64(0); seed < 5; seed++ {
+				spec := &Spec{Type: ErdosRenyi, P: tc.p, Seed: seed}
+				edges, err := spec.edges(peerNames(tc.n))
+				if err != nil {
+					t.Fatal(err)
+				}
+				degrees(t, tc.n, edges)
+				if len(edges) < tc.min || len(edges) > tc.max {
+					t.Fatalf("seed %d: expected between %d and %d edges, got %d", seed, tc.min, tc.max, len(edges))
+				}
+			}
+		})
+	}
+}
+
+func TestEdgesDeterministic(t *testing.T) {
+	for _, spec := range []*Spec{
+		{Type: KRegular, K: 4},
+		{Type: ErdosRenyi, P: 0.2},
+		{Type: ScaleFree, M: 2},
+	} {
+		t.Run(spec.Type, func(t *testing.T) {
+			names := peerNames(30)
+			spec.Seed = 42
+			a, err := spec.edges(names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := spec.edges(names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(a, b) {
+				t.Fatal("the same seed yielded different graphs")
+			}
+			spec.Seed = 43
+			c, err := spec.edges(names)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(a, c) {
+				t.Fatal("different seeds yielded the same graph")
+			}
+		})
+	}
+}
+
+func TestCheckDialable(t *testing.T) {
+	addr, err := ma.NewMultiaddr("/ip4/10.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemons := make([]*daemon, 3)
+	for i := range daemons {
+		daemons[i] = &daemon{node: &Node{Name: nodeName("peers", i)}}
+	}
+	// Only the last peer listens.
+	daemons[2].addrs = []ma.Multiaddr{addr}
+
+	for _, tc := range []struct {
+		name  string
+		edges [][2]int
+		fails bool
+	}{
+		{name: "no edges"},
+		{name: "dialing a listening peer", edges: [][2]int{{0, 2}, {1, 2}}},
+		{name: "dialing a peer without addresses", edges: [][2]int{{0, 1}}, fails: true},
+		{name: "some undialable", edges: [][2]int{{0, 2}, {0, 1}}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkDialable(daemons, tc.edges)
+			if tc.fails && err == nil {
+				t.Fatal("expected an error")
+			} else if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package connectivity
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	capi "github.com/hashicorp/consul/api"
+	"github.com/libp2p/go-libp2p-daemon/p2pclient"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/testlab/utils"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/sirupsen/logrus"
+)
+
+// DaemonServiceName is the name of the consul service exposing a peer's
+// daemon control endpoint.
+const DaemonServiceName = "p2pd"
+
+const defaultParallelism = 16
+
+// Connector connects the daemons of a run into graphs.
+type Connector struct {
+	consul *capi.Client
+	runID  string
+}
+
+// NewConnector creates a Connector operating on the daemons of the given run.
+func NewConnector(consul *capi.Client, runID string) *Connector {
+	return &Connector{consul: consul, runID: runID}
+}
+
+type daemon struct {
+	node        *Node
+	controlAddr string
+	id          peer.ID
+	addrs       []ma.Multiaddr
+}
+
+// Connect connects the daemons of the spec's deployments into its graph,
+// recording the intended graph in the run's KV namespace under
+// "connectivity/intended". Every edge is attempted even if some fail.
+func (c *Connector) Connect(ctx context.Context, spec *Spec) (*Graph, error) {
+	if err := spec.Validate(); err != nil {
+		return nil, err
+	}
+	parallelism := spec.Parallelism
+	if parallelism == 0 {
+		parallelism = defaultParallelism
+	}
+	daemons, err := c.daemons(ctx, spec.Deployments, parallelism)
+	if err != nil {
+		return nil, err
+	}
+	graph := &Graph{Nodes: make([]*Node, len(daemons))}
+	names := make([]string, len(daemons))
+	for i, d := range daemons {
+		graph.Nodes[i] = d.node
+		names[i] = d.node.Name
+	}
+	if graph.Edges, err = spec.edges(names); err != nil {
+		return nil, err
+	}
+	if err := checkDialable(daemons, graph.Edges); err != nil {
+		return nil, err
+	}
+	if err := c.record("intended", graph); err != nil {
+		return nil, err
+	}
+
+	// Edges are dialed by their lowest peer, so that each daemon only needs
+	// one client.
+	dials := make(map[string][]*daemon)
+	var sources []string
+	for _, e := range graph.Edges {
+		from := daemons[e[0]]
+		if _, ok := dials[from.controlAddr]; !ok {
+			sources = append(sources, from.controlAddr)
+		}
+		dials[from.controlAddr] = append(dials[from.controlAddr], daemons[e[1]])
+	}
+	logrus.Infof("connecting %d peers with %d edges", len(daemons), len(graph.Edges))
+	err = utils.ForEach(ctx, parallelism, sources, func(ctx context.Context, controlAddr string) error {
+		return utils.WithDaemonClient(controlAddr, func(client *p2pclient.Client) error {
+			errs := make(utils.InstanceErrors)
+			for _, to := range dials[controlAddr] {
+				if err := client.Connect(to.id, to.addrs); err != nil {
+					errs[to.node.Name] = err
+				}
+			}
+			if len(errs) > 0 {
+				return errs
+			}
+			return nil
+		})
+	})
+	return graph, err
+}
+
+// checkDialable checks that the daemons dialed by the given edges listen on
+// addresses, which p2pd daemons only do with the Undialable or NAT option, as
+// they otherwise run with -noListenAddrs.
+func checkDialable(daemons []*daemon, edges [][2]int) error {
+	var undialable []string
+	seen := make(map[int]struct{})
+	for _, e := range edges {
+		if _, ok := seen[e[1]]; ok {
+			continue
+		}
+		seen[e[1]] = struct{}{}
+		if len(daemons[e[1]].addrs) == 0 {
+			undialable = append(undialable, daemons[e[1]].node.Name)
+		}
+	}
+	if len(undialable) > 0 {
+		sort.Strings(undialable)
+		return fmt.Errorf("peers %s have no listen addresses to dial, set the Undialable or NAT option of their p2pd deployments", strings.Join(undialable, ", "))
+	}
+	return nil
+}
+
+// Observe builds the graph of the connections currently open between the
+// daemons of the given deployments, recording it in the run's KV namespace
+// under "connectivity/observed".
+func (c *Connector) Observe(ctx context.Context, deployments []string) (*Graph, error) {
+	daemons, err := c.daemons(ctx, deployments, defaultParallelism)
+	if err != nil {
+		return nil, err
+	}
+	graph := &Graph{Nodes: make([]*Node, len(daemons))}
+	index := make(map[peer.ID]int, len(daemons))
+	controlAddrs := make([]string, len(daemons))
+	for i, d := range daemons {
+		graph.Nodes[i] = d.node
+		index[d.id] = i
+		controlAddrs[i] = d.controlAddr
+	}
+
+	var lk sync.Mutex
+	edges := make(map[[2]int]struct{})
+	err = utils.ForEach(ctx, defaultParallelism, controlAddrs, func(ctx context.Context, controlAddr string) error {
+		return utils.WithDaemonClient(controlAddr, func(client *p2pclient.Client) error {
+			self, _, err := client.Identify()
+			if err != nil {
+				return err
+			}
+			peers, err := client.ListPeers()
+			if err != nil {
+				return err
+			}
+			lk.Lock()
+			defer lk.Unlock()
+			for _, p := range peers {
+				other, ok := index[p.ID]
+				if !ok {
+					continue
+				}
+				e := [2]int{index[self], other}
+				if e[1] < e[0] {
+					e[0], e[1] = e[1], e[0]
+				}
+				edges[e] = struct{}{}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	for e := range edges {
+		graph.Edges = append(graph.Edges, e)
+	}
+	sort.Slice(graph.Edges, func(i, j int) bool {
+		if graph.Edges[i][0] != graph.Edges[j][0] {
+			return graph.Edges[i][0] < graph.Edges[j][0]
+		}
+		return graph.Edges[i][1] < graph.Edges[j][1]
+	})
+	if err := c.record("observed", graph); err != nil {
+		return nil, err
+	}
+	return graph, nil
+}
+
+// Intended returns the graph recorded by Connect, or nil if there is none.
+func (c *Connector) Intended() (*Graph, error) {
+	kv, _, err := c.consul.KV().Get(utils.RunKey(c.runID, "connectivity", "intended"), nil)
+	if err != nil || kv == nil {
+		return nil, err
+	}
+	var graph Graph
+	if err := json.Unmarshal(kv.Value, &graph); err != nil {
+		return nil, err
+	}
+	return &graph, nil
+}
+
+func (c *Connector) record(name string, graph *Graph) error {
+	bs, err := json.Marshal(graph)
+	if err != nil {
+		return err
+	}
+	kv := &capi.KVPair{
+		Key:   utils.RunKey(c.runID, "connectivity", name),
+		Value: bs,
+	}
+	_, err = c.consul.KV().Put(kv, nil)
+	return err
+}
+
+// daemons identifies the daemons of the given deployments, ordered by
+// deployment and then by peer ID, first waiting for every instance of each
+// deployment to register its daemon service.
+func (c *Connector) daemons(ctx context.Context, deployments []string, parallelism int) ([]*daemon, error) {
+	var daemons []*daemon
+	for _, deployment := range deployments {
+		quantity, err := c.quantity(deployment)
+		if err != nil {
+			return nil, err
+		}
+		var svcs []*capi.CatalogService
+		err = utils.Retry(ctx, utils.DefaultBackoff, func() error {
+			var err error
+			svcs, _, err = c.consul.Catalog().Service(utils.ServiceName(c.runID, DaemonServiceName), utils.DeploymentTag(c.runID, deployment), nil)
+			if err != nil {
+				return err
+			}
+			if len(svcs) == 0 || len(svcs) < quantity {
+				return fmt.Errorf("%d of %d %s services of deployment %s registered", len(svcs), quantity, DaemonServiceName, deployment)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		controlAddrs := make([]string, len(svcs))
+		for i, svc := range svcs {
+			controlAddrs[i] = fmt.Sprintf("/ip4/%s/tcp/%d", svc.ServiceAddress, svc.ServicePort)
+		}
+
+		var lk sync.Mutex
+		var found []*daemon
+		err = utils.ForEach(ctx, parallelism, controlAddrs, func(ctx context.Context, controlAddr string) error {
+			return utils.Retry(ctx, utils.DefaultBackoff, func() error {
+				return utils.WithDaemonClient(controlAddr, func(client *p2pclient.Client) error {
+					id, addrs, err := client.Identify()
+					if err != nil {
+						return err
+					}
+					lk.Lock()
+					found = append(found, &daemon{controlAddr: controlAddr, id: id, addrs: addrs})
+					lk.Unlock()
+					return nil
+				})
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Slice(found, func(i, j int) bool { return found[i].id.Pretty() < found[j].id.Pretty() })
+		for i, d := range found {
+			d.node = &Node{Name: nodeName(deployment, i), PeerID: d.id.Pretty()}
+		}
+		daemons = append(daemons, found...)
+	}
+	return daemons, nil
+}
+
+// quantity returns the number of instances of the given deployment, as
+// recorded in the run's KV namespace when the topology was started, or 0 if it
+// was not recorded.
+func (c *Connector) quantity(deployment string) (int, error) {
+	kv, _, err := c.consul.KV().Get(utils.RunKey(c.runID, "deployments", deployment), nil)
+	if err != nil || kv == nil {
+		return 0, err
+	}
+	var deploymentCtx utils.DeploymentContext
+	if err := json.Unmarshal(kv.Value, &deploymentCtx); err != nil {
+		return 0, err
+	}
+	return deploymentCtx.Quantity, nil
+}
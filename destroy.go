@@ -0,0 +1,147 @@
+package testlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/libp2p/testlab/testlab/node"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// DeregistrationTimeout bounds how long testlab stop waits for a topology's
+// services to disappear from consul.
+var DeregistrationTimeout = 2 * time.Minute
+
+// pluginCall pairs a plugin with the context and options it is called with,
+// for each deployment and each sidecar added to it.
+type pluginCall struct {
+	name       string
+	plugin     node.Node
+	deployment *utils.DeploymentContext
+	options    utils.NodeOptions
+}
+
+// pluginCalls resolves the plugins of the topology's deployments and sidecars.
+// Plugins that cannot be resolved are logged and skipped.
+func (t *Topology) pluginCalls(env *Environment) []*pluginCall {
+	var calls []*pluginCall
+	for _, deployment := range t.Deployments {
+		deploymentCtx := t.context(env, deployment)
+		plugin, err := env.Registry.Resolve(deployment.Plugin, env.PluginPath)
+		if err != nil {
+			logrus.Errorf("deployment %s: %s", deployment.Name, err)
+		} else {
+			calls = append(calls, &pluginCall{deployment.Name, plugin, deploymentCtx, deployment.Options})
+		}
+		for _, sidecar := range t.Sidecars {
+			if !sidecar.appliesTo(deployment.Name) {
+				continue
+			}
+			name := fmt.Sprintf("%s/%s", deployment.Name, sidecar.Name)
+			plugin, err := env.Registry.Resolve(sidecar.Plugin, env.PluginPath)
+			if err != nil {
+				logrus.Errorf("sidecar %s: %s", name, err)
+				continue
+			}
+			calls = append(calls, &pluginCall{name, plugin, deploymentCtx, sidecar.Options})
+		}
+	}
+	return calls
+}
+
+func (t *TestLab) preDestroy(ctx context.Context, calls []*pluginCall) {
+	for _, call := range calls {
+		hook, ok := call.plugin.(node.PreDestroyer)
+		if !ok {
+			continue
+		}
+		if err := hook.PreDestroy(ctx, t.consul, call.deployment, call.options); err != nil {
+			logrus.Errorf("pre destroy hook of %s: %s", call.name, err)
+		}
+	}
+}
+
+func (t *TestLab) postDestroy(ctx context.Context, calls []*pluginCall) {
+	for _, call := range calls {
+		hook, ok := call.plugin.(node.PostDestroyer)
+		if !ok {
+			continue
+		}
+		if err := hook.PostDestroy(ctx, t.consul, call.deployment, call.options); err != nil {
+			logrus.Errorf("post destroy hook of %s: %s", call.name, err)
+		}
+	}
+}
+
+// waitDeregistered blocks until no service in consul carries the tag of any of
+// the topology's deployments.
+func (t *TestLab) waitDeregistered(ctx context.Context, topology *Topology) error {
+	tags := make(map[string]struct{}, len(topology.Deployments))
+	for _, deployment := range topology.Deployments {
+		tags[utils.DeploymentTag(t.runID, deployment.Name)] = struct{}{}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, DeregistrationTimeout)
+	defer cancel()
+	for {
+		services, _, err := t.consul.Catalog().Services(nil)
+		if err != nil {
+			return err
+		}
+		var remaining []string
+		for name, serviceTags := range services {
+			for _, tag := range serviceTags {
+				if _, ok := tags[tag]; ok {
+					remaining = append(remaining, name)
+					break
+				}
+			}
+		}
+		if len(remaining) == 0 {
+			logrus.Info("all services deregistered")
+			return nil
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("services %v still registered: %s", remaining, ctx.Err())
+		}
+	}
+}
+
+func (t *TestLab) topologyPath() string {
+	return filepath.Join(t.path, "topology.json")
+}
+
+// saveTopology records the topology being started, so that its plugins' hooks
+// can be run when it is stopped.
+func (t *TestLab) saveTopology(topology *Topology) error {
+	bs, err := json.Marshal(topology)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(t.topologyPath(), bs, 0644)
+}
+
+// loadTopology reads the topology recorded by saveTopology, returning nil if
+// there is none.
+func (t *TestLab) loadTopology() (*Topology, error) {
+	bs, err := ioutil.ReadFile(t.topologyPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var topology Topology
+	if err := json.Unmarshal(bs, &topology); err != nil {
+		return nil, err
+	}
+	return &topology, nil
+}
@@ -0,0 +1,105 @@
+package testlab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// EventPollInterval is how often WatchEvents polls nomad for task events.
+var EventPollInterval = 5 * time.Second
+
+// Event records a task crash, or nomad's reaction to it, during a run.
+type Event struct {
+	Job        string
+	Group      string
+	Allocation string
+	Task       string
+	// Type is the type of the nomad task event, e.g. "Terminated" or
+	// "Restarting".
+	Type     string
+	Time     time.Time
+	Message  string
+	ExitCode int
+	Signal   int
+}
+
+// recordedEventTypes are the task event types recorded as run events.
+var recordedEventTypes = map[string]struct{}{
+	napi.TaskTerminated:    {},
+	napi.TaskRestarting:    {},
+	napi.TaskNotRestarting: {},
+	napi.TaskDriverFailure: {},
+}
+
+// WatchEvents records the crashes and restarts of the current run's tasks in
+// the run's consul KV namespace, under "events/<allocation>/<task>/<time>",
+// until the context is cancelled. Each recorded event is passed to fn, if not
+// nil.
+func (t *TestLab) WatchEvents(ctx context.Context, fn func(*Event)) error {
+	if t.runID == "" {
+		return fmt.Errorf("no run in progress")
+	}
+	seen := make(map[string]struct{})
+	for {
+		for _, job := range t.jobs() {
+			if err := t.recordEvents(job, seen, fn); err != nil {
+				logrus.Errorf("listing allocations of %s: %s", job.id, err)
+			}
+		}
+		select {
+		case <-time.After(EventPollInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (t *TestLab) recordEvents(job deployedJob, seen map[string]struct{}, fn func(*Event)) error {
+	allocs, _, err := t.nomad.Jobs().Allocations(job.id, false, &napi.QueryOptions{Region: job.region})
+	if err != nil {
+		return err
+	}
+	for _, alloc := range allocs {
+		for task, state := range alloc.TaskStates {
+			for _, taskEvent := range state.Events {
+				if _, ok := recordedEventTypes[taskEvent.Type]; !ok {
+					continue
+				}
+				key := utils.RunKey(t.runID, "events", alloc.ID, task, fmt.Sprintf("%d", taskEvent.Time))
+				if _, ok := seen[key]; ok {
+					continue
+				}
+				event := &Event{
+					Job:        job.id,
+					Group:      alloc.TaskGroup,
+					Allocation: alloc.ID,
+					Task:       task,
+					Type:       taskEvent.Type,
+					Time:       time.Unix(0, taskEvent.Time),
+					Message:    taskEvent.DisplayMessage,
+					ExitCode:   taskEvent.ExitCode,
+					Signal:     taskEvent.Signal,
+				}
+				bs, err := json.Marshal(event)
+				if err != nil {
+					return err
+				}
+				if _, err := t.consul.KV().Put(&capi.KVPair{Key: key, Value: bs}, nil); err != nil {
+					return err
+				}
+				seen[key] = struct{}{}
+				if fn != nil {
+					fn(event)
+				}
+			}
+		}
+	}
+	return nil
+}
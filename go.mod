@@ -71,6 +71,7 @@ require (
 	github.com/jonboulle/clockwork v0.1.0 // indirect
 	github.com/json-iterator/go v1.1.5 // indirect
 	github.com/keybase/go-crypto v0.0.0-20181127160227-255a5089e85a // indirect
+	github.com/libp2p/go-libp2p-crypto v0.0.1
 	github.com/libp2p/go-libp2p-daemon v0.0.1
 	github.com/libp2p/go-libp2p-peer v0.0.1
 	github.com/mattbaird/elastigo v0.0.0-20170123220020-2fe47fd29e4b // indirect
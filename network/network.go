@@ -0,0 +1,298 @@
+// Package network generates sidecar tasks that emulate network conditions
+// between testlab deployments using tc/netem, and partition them from one
+// another using iptables.
+package network
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+// TaskName is the name of the sidecar task added to task groups whose
+// deployment is subject to network emulation.
+const TaskName = "network"
+
+// MaxLinks is the maximum number of links originating from a deployment. Each
+// allocation claims a slot of MaxLinks tc classes, qdisc handles and filter
+// priorities, so that allocations sharing a host neither share nor remove one
+// another's.
+const MaxLinks = 16
+
+var bandwidthRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?([kmgt]?bit|[kmgt]?bps)$`)
+
+// Link describes the conditions applied to traffic flowing from the peers of
+// one deployment to the peers of another.
+type Link struct {
+	// From is the name of the deployment whose outgoing traffic is shaped.
+	From string
+	// To is the name of the deployment whose peers the traffic is destined for.
+	To string
+	// Latency is the delay added to each packet, e.g. "150ms".
+	Latency string
+	// Jitter is the variation in Latency, e.g. "10ms".
+	Jitter string
+	// Loss is the percentage of packets to drop, from 0 to 100.
+	Loss float64
+	// Bandwidth is the rate to limit traffic to, in tc units, e.g. "10mbit".
+	Bandwidth string
+}
+
+// Validate checks that the link's conditions can be translated into tc
+// parameters.
+func (l *Link) Validate() error {
+	if l.From == "" || l.To == "" {
+		return fmt.Errorf("network links require both From and To")
+	}
+	if _, err := parseDuration(l.Latency); err != nil {
+		return fmt.Errorf("link %s -> %s: invalid Latency: %s", l.From, l.To, err)
+	}
+	if _, err := parseDuration(l.Jitter); err != nil {
+		return fmt.Errorf("link %s -> %s: invalid Jitter: %s", l.From, l.To, err)
+	}
+	if l.Jitter != "" && l.Latency == "" {
+		return fmt.Errorf("link %s -> %s: Jitter requires Latency", l.From, l.To)
+	}
+	if l.Loss < 0 || l.Loss > 100 {
+		return fmt.Errorf("link %s -> %s: Loss must be between 0 and 100, got %f", l.From, l.To, l.Loss)
+	}
+	if l.Bandwidth != "" && !bandwidthRegexp.MatchString(l.Bandwidth) {
+		return fmt.Errorf("link %s -> %s: invalid Bandwidth %q", l.From, l.To, l.Bandwidth)
+	}
+	return nil
+}
+
+// netem returns the netem parameters for this link.
+func (l *Link) netem() string {
+	var params []string
+	if l.Latency != "" {
+		latency, _ := parseDuration(l.Latency)
+		params = append(params, "delay", tcTime(latency))
+		if l.Jitter != "" {
+			jitter, _ := parseDuration(l.Jitter)
+			params = append(params, tcTime(jitter))
+		}
+	}
+	if l.Loss > 0 {
+		params = append(params, "loss", fmt.Sprintf("%g%%", l.Loss))
+	}
+	return strings.Join(params, " ")
+}
+
+func parseDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(d)
+}
+
+func tcTime(d time.Duration) string {
+	return fmt.Sprintf("%dus", d.Nanoseconds()/int64(time.Microsecond))
+}
+
+// Task generates the sidecar task for a task group of the given deployment in
+// the given run, or nil if it needs none. The sidecar applies the links
+// originating from the deployment and, if partitions is set, the partitions
+// written by a Partitioner to the libp2p port of the group's main task.
+//
+// Links are shaped on the host's default interface, in tc classes claimed by
+// each allocation. The filters match all traffic leaving the host towards the
+// target peers, so placing deployments on distinct hosts, e.g. with
+// datacenter distributions, keeps links independent.
+func Task(runID, deployment string, main *napi.Task, links []*Link, partitions bool) (*napi.Task, error) {
+	var script strings.Builder
+	script.WriteString(scriptHeader)
+	needed := false
+	n := 0
+	for _, link := range links {
+		if link.From != deployment {
+			continue
+		}
+		if err := link.Validate(); err != nil {
+			return nil, err
+		}
+		if n == MaxLinks {
+			return nil, fmt.Errorf("deployment %s has more than %d network links", deployment, MaxLinks)
+		}
+		needed = true
+		bandwidth := link.Bandwidth
+		if bandwidth == "" {
+			bandwidth = "10gbit"
+		}
+		fmt.Fprintf(&script, "apply_link %d %s %q <<'TARGETS'\n", n, bandwidth, link.netem())
+		n++
+		script.WriteString(targetsTemplate(runID, link.To))
+		script.WriteString("TARGETS\n")
+	}
+
+	task := napi.NewTask(TaskName, "raw_exec")
+	task.Env = make(map[string]string)
+	if partitions && hasPort(main, LibP2PServiceName) {
+		needed = true
+		task.Env["LIBP2P_IP"] = fmt.Sprintf("${NOMAD_IP_%s_%s}", main.Name, LibP2PServiceName)
+		task.Env["LIBP2P_PORT"] = fmt.Sprintf("${NOMAD_PORT_%s_%s}", main.Name, LibP2PServiceName)
+		rules := partitionTemplate
+		task.Templates = append(task.Templates, &napi.Template{
+			EmbeddedTmpl: &rules,
+			DestPath:     utils.StringPtr("local/partition.rules"),
+			ChangeMode:   utils.StringPtr("signal"),
+			ChangeSignal: utils.StringPtr("SIGHUP"),
+		})
+		script.WriteString(partitionScript)
+	}
+	if !needed {
+		return nil, nil
+	}
+	script.WriteString(scriptFooter)
+
+	tmpl := script.String()
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &tmpl,
+		DestPath:     utils.StringPtr("local/network.sh"),
+		ChangeMode:   utils.StringPtr("restart"),
+	})
+	task.SetConfig("command", "/bin/sh")
+	task.SetConfig("args", []string{"local/network.sh"})
+
+	res := napi.DefaultResources()
+	cpu := 50
+	res.CPU = &cpu
+	memory := 32
+	res.MemoryMB = &memory
+	task.Require(res)
+
+	return task, nil
+}
+
+func hasPort(task *napi.Task, label string) bool {
+	if task.Resources == nil {
+		return false
+	}
+	for _, network := range task.Resources.Networks {
+		for _, port := range network.DynamicPorts {
+			if port.Label == label {
+				return true
+			}
+		}
+		for _, port := range network.ReservedPorts {
+			if port.Label == label {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// targetsTemplate renders the address and port of every service registered by
+// the given deployment of the given run, one per line.
+func targetsTemplate(runID, deployment string) string {
+	tag := utils.DeploymentTag(runID, deployment)
+	return fmt.Sprintf(`{{range services}}{{if .Tags | contains %q}}{{range service .Name}}{{if .Tags | contains %q}}{{.Address}} {{.Port}}
+{{end}}{{end}}{{end}}{{end}}`, tag, tag)
+}
+
+var partitionTemplate = fmt.Sprintf(`{{ keyOrDefault (printf "%s/%%s/%s/%%s:%%s" (env %q) (env "LIBP2P_IP") (env "LIBP2P_PORT")) "" }}`, utils.KVPrefix, PartitionPrefix, utils.RunIDEnvName)
+
+const scriptHeader = `#!/bin/sh
+IF=$(ip route show default | awk '/default/ {print $5; exit}')
+IDS=""
+CHAIN=""
+SLOTS=/var/run/testlab-tc
+SLOT=""
+
+# claim_slot claims a slot of MaxLinks tc ids for this allocation, starting
+# from one derived from its ID and probing for a free one, so that
+# allocations sharing the host get distinct classes and filter priorities.
+claim_slot() {
+  mkdir -p "$SLOTS"
+  start=$(( 0x$(echo "$NOMAD_ALLOC_ID" | tr -d '-' | cut -c1-4) % 4094 ))
+  i=0
+  while [ $i -lt 4094 ]; do
+    slot=$(( (start + i) % 4094 ))
+    if mkdir "$SLOTS/$slot" 2>/dev/null; then
+      SLOT=$slot
+      echo "$NOMAD_ALLOC_ID" > "$SLOTS/$slot/alloc"
+      return
+    fi
+    i=$((i + 1))
+  done
+  echo "no free tc slot on this host" >&2
+  exit 1
+}
+
+apply_link() {
+  [ -z "$SLOT" ] && claim_slot
+  tc qdisc add dev "$IF" root handle 1: htb 2>/dev/null || true
+  # Class ids and handles are hexadecimal, priorities decimal.
+  id=$(( 16 + SLOT * 16 + $1 ))
+  hex=$(printf '%x' "$id")
+  rate=$2
+  params=$3
+  tc filter del dev "$IF" parent 1: prio "$id" 2>/dev/null || true
+  tc class replace dev "$IF" parent 1: classid "1:$hex" htb rate "$rate"
+  if [ -n "$params" ]; then
+    tc qdisc replace dev "$IF" parent "1:$hex" handle "$hex:" netem $params
+  fi
+  while read -r addr port; do
+    [ -z "$addr" ] && continue
+    tc filter add dev "$IF" parent 1: protocol ip prio "$id" u32 \
+      match ip dst "$addr/32" match ip dport "$port" 0xffff flowid "1:$hex"
+  done
+  IDS="$IDS $id"
+}
+
+`
+
+// partitionScript drops traffic between the main task and every endpoint listed
+// in the partition rules, re-applying them on SIGHUP. Traffic is dropped in
+// either direction between the peer's address and the main task's libp2p
+// port, and between the main task's address and the peer's libp2p port, so
+// that connections dialed from ephemeral ports are cut off too.
+const partitionScript = `
+CHAIN="testlab-$LIBP2P_PORT"
+iptables -N "$CHAIN" 2>/dev/null || true
+iptables -C INPUT -j "$CHAIN" 2>/dev/null || iptables -I INPUT -j "$CHAIN"
+iptables -C OUTPUT -j "$CHAIN" 2>/dev/null || iptables -I OUTPUT -j "$CHAIN"
+
+apply_partition() {
+  iptables -F "$CHAIN"
+  while read -r addr port; do
+    [ -z "$addr" ] && continue
+    iptables -A "$CHAIN" -p tcp -s "$LIBP2P_IP" --sport "$LIBP2P_PORT" -d "$addr" -j DROP
+    iptables -A "$CHAIN" -p tcp -s "$addr" -d "$LIBP2P_IP" --dport "$LIBP2P_PORT" -j DROP
+    iptables -A "$CHAIN" -p tcp -s "$LIBP2P_IP" -d "$addr" --dport "$port" -j DROP
+    iptables -A "$CHAIN" -p tcp -s "$addr" --sport "$port" -d "$LIBP2P_IP" -j DROP
+  done < local/partition.rules
+}
+apply_partition
+trap apply_partition HUP
+`
+
+const scriptFooter = `
+cleanup() {
+  for id in $IDS; do
+    hex=$(printf '%x' "$id")
+    tc filter del dev "$IF" parent 1: prio "$id" 2>/dev/null || true
+    tc qdisc del dev "$IF" parent "1:$hex" 2>/dev/null || true
+    tc class del dev "$IF" classid "1:$hex" 2>/dev/null || true
+  done
+  [ -n "$SLOT" ] && rm -rf "$SLOTS/$SLOT"
+  if [ -n "$CHAIN" ]; then
+    iptables -D INPUT -j "$CHAIN" 2>/dev/null || true
+    iptables -D OUTPUT -j "$CHAIN" 2>/dev/null || true
+    iptables -F "$CHAIN" 2>/dev/null || true
+    iptables -X "$CHAIN" 2>/dev/null || true
+  fi
+  exit 0
+}
+trap cleanup INT TERM
+
+while true; do
+  sleep 3600 &
+  wait $!
+done
+`
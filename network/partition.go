@@ -0,0 +1,155 @@
+package network
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	capi "github.com/hashicorp/consul/api"
+	"github.com/libp2p/testlab/utils"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// PartitionPrefix is the consul KV prefix, within a run's namespace, holding
+// the endpoints each peer should block while the network is partitioned. Keys
+// are of the form "testlab/<run id>/<prefix>/<ip>:<port>" for the libp2p
+// endpoint of each partitioned peer.
+const PartitionPrefix = "partition"
+
+// LibP2PServiceName is the name of the consul service exposing a peer's libp2p
+// endpoint. Partitions only apply to deployments registering it.
+const LibP2PServiceName = "libp2p"
+
+type endpoint struct {
+	ip   string
+	port int
+}
+
+func (e endpoint) String() string {
+	return fmt.Sprintf("%s:%d", e.ip, e.port)
+}
+
+// Partitioner splits the peers of a topology into isolated islands, by
+// instructing the network sidecars of the affected peers to drop traffic on
+// their libp2p ports.
+type Partitioner struct {
+	consul *capi.Client
+	runID  string
+}
+
+// NewPartitioner creates a Partitioner operating on the peers of the given run
+// in the given consul cluster.
+func NewPartitioner(consul *capi.Client, runID string) *Partitioner {
+	return &Partitioner{consul: consul, runID: runID}
+}
+
+// Partition isolates the given islands from one another. Each island is a set
+// of deployment names or peer IDs. Peers in no island are left untouched, and
+// any previous partition is replaced.
+func (p *Partitioner) Partition(islands ...[]string) error {
+	if len(islands) < 2 {
+		return fmt.Errorf("partitions require at least 2 islands, got %d", len(islands))
+	}
+
+	peerIDs, err := p.peerIDs()
+	if err != nil {
+		return err
+	}
+
+	resolved := make([][]endpoint, len(islands))
+	for i, island := range islands {
+		for _, member := range island {
+			endpoints, err := p.resolve(member, peerIDs)
+			if err != nil {
+				return err
+			}
+			resolved[i] = append(resolved[i], endpoints...)
+		}
+	}
+
+	if err := p.Heal(); err != nil {
+		return err
+	}
+	for i, island := range resolved {
+		var blocked []string
+		for e, other := range resolved {
+			if e == i {
+				continue
+			}
+			for _, ep := range other {
+				blocked = append(blocked, fmt.Sprintf("%s %d", ep.ip, ep.port))
+			}
+		}
+		sort.Strings(blocked)
+		rules := []byte(strings.Join(blocked, "\n") + "\n")
+		for _, ep := range island {
+			kv := &capi.KVPair{
+				Key:   utils.RunKey(p.runID, PartitionPrefix, ep.String()),
+				Value: rules,
+			}
+			if _, err := p.consul.KV().Put(kv, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Heal removes any partition, restoring connectivity between all peers.
+func (p *Partitioner) Heal() error {
+	_, err := p.consul.KV().DeleteTree(utils.RunKey(p.runID, PartitionPrefix)+"/", nil)
+	return err
+}
+
+// resolve finds the libp2p endpoints of a deployment, or of a single peer if
+// member is a known peer ID.
+func (p *Partitioner) resolve(member string, peerIDs map[string][]endpoint) ([]endpoint, error) {
+	if endpoints, ok := peerIDs[member]; ok {
+		return endpoints, nil
+	}
+	svcs, _, err := p.consul.Catalog().Service(utils.ServiceName(p.runID, LibP2PServiceName), utils.DeploymentTag(p.runID, member), nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(svcs) == 0 {
+		return nil, fmt.Errorf("%s is neither a known peer ID nor a deployment with %s services", member, LibP2PServiceName)
+	}
+	endpoints := make([]endpoint, len(svcs))
+	for i, svc := range svcs {
+		endpoints[i] = endpoint{ip: svc.ServiceAddress, port: svc.ServicePort}
+	}
+	return endpoints, nil
+}
+
+// peerIDs maps the peer IDs recorded in the run's KV namespace to their
+// endpoints.
+func (p *Partitioner) peerIDs() (map[string][]endpoint, error) {
+	prefix := utils.RunKey(p.runID, "peerids")
+	kvs, _, err := p.consul.KV().List(prefix+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	peerIDs := make(map[string][]endpoint)
+	for _, kv := range kvs {
+		addr, err := ma.NewMultiaddr(strings.TrimPrefix(kv.Key, prefix))
+		if err != nil {
+			continue
+		}
+		ip, err := addr.ValueForProtocol(ma.P_IP4)
+		if err != nil {
+			continue
+		}
+		portStr, err := addr.ValueForProtocol(ma.P_TCP)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			continue
+		}
+		id := string(kv.Value)
+		peerIDs[id] = append(peerIDs[id], endpoint{ip: ip, port: port})
+	}
+	return peerIDs, nil
+}
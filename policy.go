@@ -0,0 +1,87 @@
+package testlab
+
+import (
+	"fmt"
+	"time"
+
+	napi "github.com/hashicorp/nomad/api"
+)
+
+// RestartPolicy configures how nomad restarts a deployment's failed tasks in
+// place. Unset fields keep nomad's defaults.
+type RestartPolicy struct {
+	// Attempts is the number of restarts allowed within Interval.
+	Attempts *int
+	// Interval and Delay are durations, e.g. "30m" and "15s".
+	Interval string
+	Delay    string
+	// Mode is "fail" or "delay", what to do once Attempts are exhausted.
+	Mode string
+}
+
+func (p *RestartPolicy) nomad() (*napi.RestartPolicy, error) {
+	policy := &napi.RestartPolicy{Attempts: p.Attempts}
+	var err error
+	if policy.Interval, err = durationPtr("restart Interval", p.Interval); err != nil {
+		return nil, err
+	}
+	if policy.Delay, err = durationPtr("restart Delay", p.Delay); err != nil {
+		return nil, err
+	}
+	switch p.Mode {
+	case "":
+	case "fail", "delay":
+		policy.Mode = &p.Mode
+	default:
+		return nil, fmt.Errorf("restart Mode must be fail or delay, got %q", p.Mode)
+	}
+	return policy, nil
+}
+
+// ReschedulePolicy configures how nomad reschedules a deployment's failed
+// allocations onto other nodes. Unset fields keep nomad's defaults.
+type ReschedulePolicy struct {
+	// Attempts is the number of reschedules allowed within Interval.
+	Attempts *int
+	// Interval, Delay and MaxDelay are durations, e.g. "1h" and "30s".
+	Interval string
+	Delay    string
+	MaxDelay string
+	// DelayFunction is "constant", "exponential" or "fibonacci".
+	DelayFunction string
+	// Unlimited allows unlimited reschedules.
+	Unlimited *bool
+}
+
+func (p *ReschedulePolicy) nomad() (*napi.ReschedulePolicy, error) {
+	policy := &napi.ReschedulePolicy{Attempts: p.Attempts, Unlimited: p.Unlimited}
+	var err error
+	if policy.Interval, err = durationPtr("reschedule Interval", p.Interval); err != nil {
+		return nil, err
+	}
+	if policy.Delay, err = durationPtr("reschedule Delay", p.Delay); err != nil {
+		return nil, err
+	}
+	if policy.MaxDelay, err = durationPtr("reschedule MaxDelay", p.MaxDelay); err != nil {
+		return nil, err
+	}
+	switch p.DelayFunction {
+	case "":
+	case "constant", "exponential", "fibonacci":
+		policy.DelayFunction = &p.DelayFunction
+	default:
+		return nil, fmt.Errorf("reschedule DelayFunction must be constant, exponential or fibonacci, got %q", p.DelayFunction)
+	}
+	return policy, nil
+}
+
+func durationPtr(name, value string) (*time.Duration, error) {
+	if value == "" {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return &d, nil
+}
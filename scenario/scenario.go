@@ -2,14 +2,20 @@ package scenario
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
 	"github.com/libp2p/go-libp2p-daemon/p2pclient"
+	"github.com/libp2p/testlab/chaos"
+	"github.com/libp2p/testlab/connectivity"
+	"github.com/libp2p/testlab/network"
 	"github.com/libp2p/testlab/utils"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
@@ -31,8 +37,14 @@ func RunScenario(scenario Scenario) {
 type ScenarioRunner struct {
 	consulConfig *capi.Config
 	consul       *capi.Client
+	nomadConfig  *napi.Config
+	nomad        *napi.Client
+	injector     *chaos.Injector
 	root         string
 	tag          string
+	topology     string
+	deployment   string
+	runID        string
 	numClients   int
 }
 
@@ -61,8 +73,12 @@ func NewScenarioRunner() (*ScenarioRunner, error) {
 
 	runner := &ScenarioRunner{
 		consulConfig: consulConfig,
+		nomadConfig:  napi.DefaultConfig(),
 		root:         root,
 		tag:          tag,
+		topology:     os.Getenv(utils.TopologyEnvName),
+		deployment:   os.Getenv(utils.DeploymentEnvName),
+		runID:        os.Getenv(utils.RunIDEnvName),
 		numClients:   numClients,
 	}
 
@@ -84,13 +100,157 @@ func (s *ScenarioRunner) ConsulClient() (*capi.Client, error) {
 	return s.consul, nil
 }
 
+// NomadClient creates a nomad client from the given environment.
+func (s *ScenarioRunner) NomadClient() (*napi.Client, error) {
+	if s.nomad != nil {
+		return s.nomad, nil
+	}
+
+	client, err := napi.NewClient(s.nomadConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s.nomad = client
+	return s.nomad, nil
+}
+
+// Injector returns a fault injector for the topology this scenario is running
+// in.
+func (s *ScenarioRunner) Injector() (*chaos.Injector, error) {
+	if s.injector != nil {
+		return s.injector, nil
+	}
+	if s.topology == "" {
+		return nil, fmt.Errorf("%s not present in environment", utils.TopologyEnvName)
+	}
+	if s.runID == "" {
+		return nil, fmt.Errorf("%s not present in environment", utils.RunIDEnvName)
+	}
+
+	nomad, err := s.NomadClient()
+	if err != nil {
+		return nil, err
+	}
+	consul, err := s.ConsulClient()
+	if err != nil {
+		return nil, err
+	}
+
+	s.injector = chaos.NewInjector(nomad, consul, s.topology, s.runID)
+	return s.injector, nil
+}
+
+// Kill sends SIGKILL to percent of the named deployment's allocations.
+func (s *ScenarioRunner) Kill(deployment string, percent float64) (*chaos.Record, error) {
+	injector, err := s.Injector()
+	if err != nil {
+		return nil, err
+	}
+	return injector.Kill(deployment, percent)
+}
+
+// Pause stops percent of the named deployment's allocations for the given
+// duration, blocking until they are resumed.
+func (s *ScenarioRunner) Pause(ctx context.Context, deployment string, percent float64, duration time.Duration) (*chaos.Record, error) {
+	injector, err := s.Injector()
+	if err != nil {
+		return nil, err
+	}
+	return injector.Pause(ctx, deployment, percent, duration)
+}
+
+// Disk saturates the disks of percent of the named deployment's allocations
+// for the given duration, blocking until they are restored. The deployment
+// must have been scheduled with disk faults enabled.
+func (s *ScenarioRunner) Disk(ctx context.Context, deployment string, percent float64, duration time.Duration) (*chaos.Record, error) {
+	injector, err := s.Injector()
+	if err != nil {
+		return nil, err
+	}
+	return injector.Disk(ctx, deployment, percent, duration)
+}
+
+// Partition isolates the given islands of deployment names or peer IDs from
+// one another until Heal is called. The affected deployments must have been
+// scheduled with partitions enabled.
+func (s *ScenarioRunner) Partition(islands ...[]string) error {
+	partitioner, err := s.partitioner()
+	if err != nil {
+		return err
+	}
+	return partitioner.Partition(islands...)
+}
+
+// Heal removes any partition, restoring connectivity between all peers.
+func (s *ScenarioRunner) Heal() error {
+	partitioner, err := s.partitioner()
+	if err != nil {
+		return err
+	}
+	return partitioner.Heal()
+}
+
+// Connector returns a connector for the daemons of the run this scenario is
+// part of, e.g. to compare the observed connectivity graph with the intended
+// one.
+func (s *ScenarioRunner) Connector() (*connectivity.Connector, error) {
+	if s.runID == "" {
+		return nil, fmt.Errorf("%s not present in environment", utils.RunIDEnvName)
+	}
+	client, err := s.ConsulClient()
+	if err != nil {
+		return nil, err
+	}
+	return connectivity.NewConnector(client, s.runID), nil
+}
+
+func (s *ScenarioRunner) partitioner() (*network.Partitioner, error) {
+	if s.runID == "" {
+		return nil, fmt.Errorf("%s not present in environment", utils.RunIDEnvName)
+	}
+	client, err := s.ConsulClient()
+	if err != nil {
+		return nil, err
+	}
+	return network.NewPartitioner(client, s.runID), nil
+}
+
+// Key returns the consul KV key of the given path within the namespace of the
+// run this scenario is part of.
+func (s *ScenarioRunner) Key(elem ...string) string {
+	return utils.RunKey(s.runID, elem...)
+}
+
+// RecordResult stores the JSON encoding of value in consul's KV store, under
+// "results/<deployment>/<name>" in the run's namespace.
+func (s *ScenarioRunner) RecordResult(name string, value interface{}) error {
+	if s.runID == "" {
+		return fmt.Errorf("%s not present in environment", utils.RunIDEnvName)
+	}
+	client, err := s.ConsulClient()
+	if err != nil {
+		return err
+	}
+	bs, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	kv := &capi.KVPair{
+		Key:   s.Key("results", s.deployment, name),
+		Value: bs,
+	}
+	_, err = client.KV().Put(kv, nil)
+	return err
+}
+
 func (s *ScenarioRunner) PeerControlAddrs() ([]ma.Multiaddr, error) {
 	client, err := s.ConsulClient()
 	if err != nil {
 		return nil, err
 	}
 
-	return utils.PeerControlAddrs(client, "p2pd", s.tag)
+	return utils.PeerControlAddrs(client, utils.ServiceName(s.runID, "p2pd"), s.tag)
 }
 
 func (s *ScenarioRunner) Peers() ([]*p2pclient.Client, error) {
@@ -1,6 +1,8 @@
 package testlab
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -10,22 +12,56 @@ import (
 
 	capi "github.com/hashicorp/consul/api"
 	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
+	"github.com/libp2p/testlab/chaos"
+	"github.com/libp2p/testlab/connectivity"
+	"github.com/libp2p/testlab/testlab/node"
+	"github.com/libp2p/testlab/utils"
+	// Register the built in plugins in the default registry.
+	_ "github.com/libp2p/testlab/testlab/node/builtin"
 	"github.com/sirupsen/logrus"
 )
 
 // TestLab is the main entrypoint for manipulating the test cluster.
 type TestLab struct {
 	path           string
+	nomadConfig    *napi.Config
 	nomad          *napi.Client
+	consulConfig   *capi.Config
 	consul         *capi.Client
 	deploymentPath string
+	runPath        string
+	runID          string
 	deployments    []string
+	pluginPath     []string
+	registry       *node.Registry
+	artifacts      *artifact.Server
 }
 
+// Option configures a TestLab.
+type Option func(*TestLab) error
+
+// WithRegistry makes the testlab resolve plugins from the given registry,
+// rather than the default one. The built in plugins can be added to it with
+// builtin.Register.
+func WithRegistry(registry *node.Registry) Option {
+	return func(t *TestLab) error {
+		if registry == nil {
+			return fmt.Errorf("registry must not be nil")
+		}
+		t.registry = registry
+		return nil
+	}
+}
+
+// PluginPathEnvName is the environment variable listing additional
+// directories, separated like PATH, to search for external plugins.
+const PluginPathEnvName = "TESTLAB_PLUGIN_PATH"
+
 // NewTestlab initiates a testlab, with a path to the current state of the
 // testlab as well as a configuration for contacting the nomad cluster. If nil,
 // nomadConfig will be populated with the defaults.
-func NewTestlab(path string) (*TestLab, error) {
+func NewTestlab(path string, opts ...Option) (*TestLab, error) {
 	consulConfig := capi.DefaultConfig()
 	consul, err := capi.NewClient(consulConfig)
 	if err != nil {
@@ -58,38 +94,141 @@ func NewTestlab(path string) (*TestLab, error) {
 		deployments = strings.Split(strings.TrimSpace(string(bs)), "\n")
 	}
 
+	pluginPath := []string{filepath.Join(path, "plugins")}
+	if envPath, ok := os.LookupEnv(PluginPathEnvName); ok {
+		pluginPath = append(pluginPath, filepath.SplitList(envPath)...)
+	}
+
+	runPath := filepath.Join(path, "run")
+	var runID string
+	if bs, err := ioutil.ReadFile(runPath); err == nil {
+		runID = strings.TrimSpace(string(bs))
+	}
+
 	testLab := &TestLab{
 		path:           path,
+		nomadConfig:    nomadConfig,
 		nomad:          nomad,
+		consulConfig:   consulConfig,
 		consul:         consul,
 		deploymentPath: deploymentPath,
+		runPath:        runPath,
+		runID:          runID,
 		deployments:    deployments,
+		pluginPath:     pluginPath,
+		registry:       node.DefaultRegistry,
+	}
+	for _, opt := range opts {
+		if err := opt(testLab); err != nil {
+			return nil, err
+		}
 	}
 	return testLab, nil
 }
 
-// Clear stops a running deployment
-func (t *TestLab) Clear() error {
+// Clear stops a running deployment, running the teardown hooks of its plugins
+// around the deregistration of its jobs.
+func (t *TestLab) Clear(ctx context.Context) error {
 	if t.deployments == nil {
 		logrus.Info("no existing deployment to tear down")
 		return nil
 	}
 
-	for _, deployment := range t.deployments {
-		evalID, _, err := t.nomad.Jobs().Deregister(deployment, false, nil)
+	topology, err := t.loadTopology()
+	if err != nil {
+		logrus.Errorf("loading topology, skipping teardown hooks: %s", err)
+	}
+	var calls []*pluginCall
+	if topology != nil {
+		calls = topology.pluginCalls(t.environment(t.runID))
+		t.preDestroy(ctx, calls)
+	}
+
+	for _, job := range t.jobs() {
+		var q *napi.WriteOptions
+		if job.region != "" {
+			q = &napi.WriteOptions{Region: job.region}
+		}
+		evalID, _, err := t.nomad.Jobs().Deregister(job.id, false, q)
 		if err != nil {
 			logrus.Errorf("deregistering deployment: %s", err)
 		} else {
-			logrus.Infof("deregistered job %s in evaluation %s", deployment, evalID)
+			logrus.Infof("deregistered job %s in evaluation %s", job.id, evalID)
+		}
+	}
+
+	if topology != nil {
+		if err := t.waitDeregistered(ctx, topology); err != nil {
+			logrus.Errorf("waiting for services to deregister: %s", err)
+		}
+		t.postDestroy(ctx, calls)
+	}
+
+	if t.runID != "" {
+		if _, err := t.consul.KV().DeleteTree(utils.RunKey(t.runID)+"/", nil); err != nil {
+			logrus.Errorf("deleting run data: %s", err)
 		}
 	}
 
+	if err := os.Remove(t.topologyPath()); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("removing topology: %s", err)
+	}
+	if err := os.Remove(t.runPath); err != nil && !os.IsNotExist(err) {
+		logrus.Errorf("removing run id: %s", err)
+	}
+	t.runID = ""
 	return os.Remove(t.deploymentPath)
 }
 
+type deployedJob struct {
+	id     string
+	region string
+}
+
+// jobs returns the nomad jobs of the current deployment.
+func (t *TestLab) jobs() []deployedJob {
+	var jobs []deployedJob
+	for _, deployment := range t.deployments {
+		// Each line holds a job ID, optionally followed by the region it was
+		// registered in.
+		fields := strings.Fields(deployment)
+		if len(fields) == 0 {
+			continue
+		}
+		job := deployedJob{id: fields[0]}
+		if len(fields) > 1 {
+			job.region = fields[1]
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (t *TestLab) environment(runID string) *Environment {
+	return &Environment{
+		RunID:      runID,
+		Consul:     t.consulConfig,
+		Nomad:      t.nomadConfig,
+		Registry:   t.registry,
+		PluginPath: t.pluginPath,
+	}
+}
+
+// RunID returns the ID of the topology run currently deployed by this testlab,
+// or an empty string if there is none.
+func (t *TestLab) RunID() string {
+	return t.runID
+}
+
+// WaitEval blocks until the given evaluation has completed and all of its
+// allocations are running.
 func (t *TestLab) WaitEval(evalID string) error {
+	return t.waitEval(evalID, nil)
+}
+
+func (t *TestLab) waitEval(evalID string, q *napi.QueryOptions) error {
 	for {
-		info, _, err := t.nomad.Evaluations().Info(evalID, nil)
+		info, _, err := t.nomad.Evaluations().Info(evalID, q)
 		if err != nil {
 			return err
 		}
@@ -97,7 +236,7 @@ func (t *TestLab) WaitEval(evalID string) error {
 			time.Sleep(time.Second)
 			continue
 		}
-		evalInfo, _, err := t.nomad.Evaluations().Info(evalID, nil)
+		evalInfo, _, err := t.nomad.Evaluations().Info(evalID, q)
 		if err != nil {
 			return err
 		}
@@ -108,7 +247,7 @@ func (t *TestLab) WaitEval(evalID string) error {
 				break
 			}
 		}
-		allocInfos, _, err := t.nomad.Evaluations().Allocations(evalID, nil)
+		allocInfos, _, err := t.nomad.Evaluations().Allocations(evalID, q)
 		if err != nil {
 			return err
 		}
@@ -126,36 +265,163 @@ func (t *TestLab) WaitEval(evalID string) error {
 	return nil
 }
 
-func (t *TestLab) Start(topology *Topology) error {
-	jobs, postDeployFuncs, err := topology.Jobs()
+// Plugins lists the plugins available to topologies started by this testlab.
+func (t *TestLab) Plugins() ([]*node.PluginInfo, error) {
+	return t.registry.List(t.pluginPath)
+}
+
+// Start deploys the topology, phase by phase, running each phase's post deploy
+// hooks once it is scheduled. Cancelling the context aborts the hooks.
+func (t *TestLab) Start(ctx context.Context, topology *Topology) (err error) {
+	runID := utils.NewRunID(topology.Name)
+	env := t.environment(runID)
+	if topology.Options != nil && topology.Options.Artifacts != nil {
+		if env.Artifacts, err = t.startArtifactServer(topology.Options.Artifacts); err != nil {
+			return err
+		}
+		// Nothing serves the artifacts once Start fails, so the server is
+		// closed rather than leaked.
+		defer func() {
+			if err != nil && t.artifacts != nil {
+				t.artifacts.Close()
+				t.artifacts = nil
+			}
+		}()
+	}
+	jobs, postDeployFuncs, err := topology.Jobs(env)
 	if err != nil {
 		return err
 	}
+	if err := ioutil.WriteFile(t.runPath, []byte(runID+"\n"), 0644); err != nil {
+		return err
+	}
+	if err := t.saveTopology(topology); err != nil {
+		return err
+	}
+	t.runID = runID
+	logrus.Infof("starting run %s", runID)
+	if err := t.recordRun(topology, env); err != nil {
+		return err
+	}
 	deploymentFile, err := os.OpenFile(t.deploymentPath, os.O_CREATE|os.O_WRONLY, 0755)
 	if err != nil {
 		return err
 	}
 	defer deploymentFile.Close()
-	for i, job := range jobs {
+	for i, phaseJobs := range jobs {
 		logrus.Infof("scheduling phase %d...", i)
-		resp, _, err := t.nomad.Jobs().Register(job, nil)
-		if err == nil {
-			logrus.Infof("rendering topology in evaluation id %s took %s", resp.EvalID, resp.RequestTime.String())
-			deploymentFile.WriteString(fmt.Sprintf("%s\n", *job.ID))
-			deploymentFile.Sync()
-		} else {
-			return err
+		evalIDs := make([]string, len(phaseJobs))
+		for e, job := range phaseJobs {
+			resp, _, err := t.nomad.Jobs().Register(job, &napi.WriteOptions{Region: *job.Region})
+			if err == nil {
+				logrus.Infof("rendering job %s in region %s in evaluation id %s took %s", *job.ID, *job.Region, resp.EvalID, resp.RequestTime.String())
+				deploymentFile.WriteString(fmt.Sprintf("%s %s\n", *job.ID, *job.Region))
+				deploymentFile.Sync()
+			} else {
+				return err
+			}
+			evalIDs[e] = resp.EvalID
 		}
-		if err = t.WaitEval(resp.EvalID); err != nil {
-			return err
+		for e, evalID := range evalIDs {
+			q := &napi.QueryOptions{Region: *phaseJobs[e].Region}
+			if err = t.waitEval(evalID, q); err != nil {
+				return err
+			}
 		}
 		logrus.Infof("phase %d scheduled, running post deploy hooks...", i)
 		for _, postDeployFunc := range postDeployFuncs[i] {
-			if err := postDeployFunc(t.consul); err != nil {
+			if err := postDeployFunc(ctx, t.consul); err != nil {
 				return err
 			}
 		}
 		logrus.Infof("phase %d complete", i)
 	}
+	if topology.Connectivity != nil {
+		spec := *topology.Connectivity
+		spec.Deployments = topology.connectivityDeployments()
+		if _, err := connectivity.NewConnector(t.consul, runID).Connect(ctx, &spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startArtifactServer starts serving the run's artifacts if the options call
+// for it, returning the configuration plugins resolve artifacts with.
+func (t *TestLab) startArtifactServer(opts *artifact.Options) (*utils.ArtifactConfig, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	config := &utils.ArtifactConfig{
+		Gateway: opts.Gateway,
+		IPFSAPI: opts.IPFSAPI,
+		Dir:     filepath.Join(t.path, "artifacts"),
+	}
+	if opts.Listen == "" {
+		return config, nil
+	}
+	server, err := artifact.Listen(config.Dir, opts.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("starting the artifact server: %s", err)
+	}
+	config.ServerURL = opts.URL
+	if config.ServerURL == "" {
+		if config.ServerURL, err = server.URL(); err != nil {
+			server.Close()
+			return nil, err
+		}
+	}
+	logrus.Infof("serving artifacts from %s at %s", config.Dir, config.ServerURL)
+	t.artifacts = server
+	return config, nil
+}
+
+// ServeArtifacts blocks until the context is cancelled while the artifact
+// server started by Start serves the run's artifacts, so that rescheduled
+// allocations can still fetch them. It returns immediately if no artifact
+// server was started.
+func (t *TestLab) ServeArtifacts(ctx context.Context) error {
+	if t.artifacts == nil {
+		return nil
+	}
+	logrus.Infof("serving artifacts on %s until interrupted", t.artifacts.Addr())
+	<-ctx.Done()
+	err := t.artifacts.Close()
+	t.artifacts = nil
+	return err
+}
+
+// recordRun stores the topology, and the context of each of its deployments, in
+// the run's consul KV namespace.
+func (t *TestLab) recordRun(topology *Topology, env *Environment) error {
+	bs, err := json.Marshal(topology)
+	if err != nil {
+		return err
+	}
+	kvs := []*capi.KVPair{{Key: utils.RunKey(env.RunID, "topology"), Value: bs}}
+	for _, deployment := range topology.Deployments {
+		bs, err := json.Marshal(topology.context(env, deployment))
+		if err != nil {
+			return err
+		}
+		kvs = append(kvs, &capi.KVPair{Key: utils.RunKey(env.RunID, "deployments", deployment.Name), Value: bs})
+	}
+	for _, kv := range kvs {
+		if _, err := t.consul.KV().Put(kv, nil); err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// InjectFaults injects the topology's faults into its running deployments,
+// timed relative to the moment it is called, blocking until every fault has
+// been undone or the context is cancelled.
+func (t *TestLab) InjectFaults(ctx context.Context, topology *Topology) error {
+	if len(topology.Faults) == 0 {
+		return nil
+	}
+	logrus.Infof("injecting %d faults...", len(topology.Faults))
+	injector := chaos.NewInjector(t.nomad, t.consul, topology.Name, t.runID)
+	return injector.Run(ctx, time.Now(), topology.Faults)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/libp2p/testlab"
+	"github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+func events(c *cli.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigch)
+	go func() {
+		select {
+		case <-sigch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return testLab.WatchEvents(ctx, logEvent)
+}
+
+func logEvent(event *testlab.Event) {
+	logrus.Warnf("%s: task %s of allocation %s: %s (exit code %d, signal %d) %s",
+		event.Time.Format("15:04:05"), event.Task, event.Allocation, event.Type, event.ExitCode, event.Signal, event.Message)
+}
+
+var Events = cli.Command{
+	Name:        "events",
+	Description: "Record task crashes and restarts of the running topology until interrupted",
+	Action:      events,
+}
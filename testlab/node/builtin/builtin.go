@@ -0,0 +1,39 @@
+// Package builtin registers the plugins that ship with testlab. Importing it
+// registers them in the default registry.
+package builtin
+
+import (
+	"github.com/libp2p/testlab/testlab/node"
+	"github.com/libp2p/testlab/testlab/node/generic"
+	"github.com/libp2p/testlab/testlab/node/ipfs"
+	"github.com/libp2p/testlab/testlab/node/p2pd"
+	"github.com/libp2p/testlab/testlab/node/prometheus"
+	"github.com/libp2p/testlab/testlab/node/relay"
+	"github.com/libp2p/testlab/testlab/node/rendezvous"
+	"github.com/libp2p/testlab/testlab/node/scenario"
+)
+
+func init() {
+	if err := Register(node.DefaultRegistry); err != nil {
+		panic(err)
+	}
+}
+
+// Register adds the built in plugins to the given registry.
+func Register(r *node.Registry) error {
+	factories := map[string]node.Factory{
+		"p2pd":       func() node.Node { return new(p2pd.Node) },
+		"scenario":   func() node.Node { return new(scenario.Node) },
+		"prometheus": func() node.Node { return new(prometheus.Node) },
+		"ipfs":       func() node.Node { return new(ipfs.Node) },
+		"generic":    func() node.Node { return new(generic.Node) },
+		"relay":      func() node.Node { return new(relay.Node) },
+		"rendezvous": func() node.Node { return new(rendezvous.Node) },
+	}
+	for name, factory := range factories {
+		if err := r.Register(name, factory); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+// Package external implements testlab nodes backed by out-of-process plugin
+// executables, speaking a simple exec+JSON protocol.
+//
+// A plugin is invoked with a single argument naming the call, a JSON request
+// on its standard input, and must write a JSON response to its standard
+// output. Anything written to standard error is logged. The calls are:
+//
+//   - "task": the request is {"Deployment": {...}, "Options": {...}}, the
+//     context of the deployment and its options, and the response is
+//     {"Task": {...}}, a nomad task in the JSON form accepted by nomad's HTTP
+//     API.
+//   - "post-deploy": the request is {"Deployment": {...}, "Options": {...}},
+//     and the response is {}.
+//   - "info": the request is {}, and the response is {"Description": "...",
+//     "Calls": [...]}, the description used when listing plugins and the
+//     optional calls below the plugin supports.
+//
+// The optional calls are only made to plugins listing them in their info
+// response:
+//
+//   - "tasks": the request is the same as for "task", and the response is
+//     {"Tasks": [...]}, several nomad tasks, the first of which is the main
+//     task. Made instead of "task".
+//   - "pre-destroy" and "post-destroy": the request is the same as for
+//     "post-deploy", and the response is {}. Made before the deployment's jobs
+//     are deregistered, and once its services are gone.
+//   - "variants": the request is {"Options": {...}}, and the response is
+//     {"Variants": [{"Name": "...", "Weight": 1, "Options": {...}}, ...]},
+//     splitting the deployment into weighted variants.
+//
+// Every response may instead set "Error" to a message describing a failure.
+// For calls given a deployment, the plugin's environment holds the CONSUL_*
+// and NOMAD_* variables needed to reach the deployment's clusters. Plugins
+// are discovered in plugin directories as executables named
+// "testlab-plugin-<name>", or referenced by path.
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Prefix is the prefix of plugin executable names in plugin directories.
+const Prefix = "testlab-plugin-"
+
+// Optional calls, made only to plugins listing them in their info response.
+const (
+	TasksCall       = "tasks"
+	PreDestroyCall  = "pre-destroy"
+	PostDestroyCall = "post-destroy"
+	VariantsCall    = "variants"
+)
+
+// Timeouts for each plugin call. Tasks and variants calls share TaskTimeout.
+var (
+	TaskTimeout       = 30 * time.Second
+	PostDeployTimeout = 10 * time.Minute
+	DestroyTimeout    = 5 * time.Minute
+	InfoTimeout       = 5 * time.Second
+)
+
+// Node is a node backed by a plugin executable.
+type Node struct {
+	Path string
+
+	infoOnce sync.Once
+	info     *response
+	infoErr  error
+}
+
+// New creates a node backed by the plugin executable at the given path.
+func New(path string) (*Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkExecutable(abs); err != nil {
+		return nil, err
+	}
+	return &Node{Path: abs}, nil
+}
+
+type request struct {
+	Deployment *utils.DeploymentContext `json:",omitempty"`
+	Options    utils.NodeOptions        `json:",omitempty"`
+}
+
+// Variant is a share of a deployment's instances run with their own options,
+// as returned by a plugin's variants call.
+type Variant struct {
+	Name    string
+	Weight  float64
+	Options utils.NodeOptions
+}
+
+type response struct {
+	Task        *napi.Task
+	Tasks       []*napi.Task
+	Variants    []*Variant
+	Description string
+	Calls       []string
+	Error       string
+}
+
+// Task asks the plugin to generate the nomad task for the given options.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	var resp response
+	req := &request{Deployment: deployment, Options: options}
+	if err := n.call(context.Background(), "task", TaskTimeout, req, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Task == nil {
+		return nil, fmt.Errorf("plugin %s returned no task", n.Path)
+	}
+	return resp.Task, nil
+}
+
+// Tasks asks the plugin to generate the nomad tasks for the given options,
+// falling back to its single task if it does not support the tasks call.
+func (n *Node) Tasks(deployment *utils.DeploymentContext, options utils.NodeOptions) ([]*napi.Task, error) {
+	supported, err := n.Supports(TasksCall)
+	if err != nil {
+		return nil, err
+	}
+	if !supported {
+		task, err := n.Task(deployment, options)
+		if err != nil {
+			return nil, err
+		}
+		return []*napi.Task{task}, nil
+	}
+
+	var resp response
+	req := &request{Deployment: deployment, Options: options}
+	if err := n.call(context.Background(), TasksCall, TaskTimeout, req, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Tasks) == 0 {
+		return nil, fmt.Errorf("plugin %s returned no tasks", n.Path)
+	}
+	return resp.Tasks, nil
+}
+
+// PostDeploy runs the plugin's post deploy hook.
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	var resp response
+	req := &request{Deployment: deployment, Options: options}
+	return n.call(ctx, "post-deploy", PostDeployTimeout, req, &resp)
+}
+
+// PreDestroy runs the plugin's pre destroy hook, if it has one.
+func (n *Node) PreDestroy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return n.destroy(ctx, PreDestroyCall, deployment, options)
+}
+
+// PostDestroy runs the plugin's post destroy hook, if it has one.
+func (n *Node) PostDestroy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return n.destroy(ctx, PostDestroyCall, deployment, options)
+}
+
+func (n *Node) destroy(ctx context.Context, method string, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	supported, err := n.Supports(method)
+	if err != nil || !supported {
+		return err
+	}
+	var resp response
+	req := &request{Deployment: deployment, Options: options}
+	return n.call(ctx, method, DestroyTimeout, req, &resp)
+}
+
+// Variants asks the plugin to split a deployment with the given options into
+// variants, returning none if it does not support the variants call.
+func (n *Node) Variants(options utils.NodeOptions) ([]*Variant, error) {
+	supported, err := n.Supports(VariantsCall)
+	if err != nil || !supported {
+		return nil, err
+	}
+	var resp response
+	if err := n.call(context.Background(), VariantsCall, TaskTimeout, &request{Options: options}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Variants, nil
+}
+
+// Description asks the plugin to describe itself.
+func (n *Node) Description() (string, error) {
+	info, err := n.getInfo()
+	if err != nil {
+		return "", err
+	}
+	return info.Description, nil
+}
+
+// Supports reports whether the plugin lists the given optional call in its
+// info response.
+func (n *Node) Supports(method string) (bool, error) {
+	info, err := n.getInfo()
+	if err != nil {
+		return false, err
+	}
+	for _, call := range info.Calls {
+		if call == method {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// getInfo makes the plugin's info call once, caching its response.
+func (n *Node) getInfo() (*response, error) {
+	n.infoOnce.Do(func() {
+		var resp response
+		if err := n.call(context.Background(), "info", InfoTimeout, &request{}, &resp); err != nil {
+			n.infoErr = err
+			return
+		}
+		n.info = &resp
+	})
+	return n.info, n.infoErr
+}
+
+func (n *Node) call(ctx context.Context, method string, timeout time.Duration, req *request, resp *response) error {
+	input, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, n.Path, method)
+	cmd.Stdin = bytes.NewReader(input)
+	if req.Deployment != nil {
+		cmd.Env = os.Environ()
+		for k, v := range utils.ConsulEnv(req.Deployment.Consul) {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+		for k, v := range utils.NomadEnv(req.Deployment.Nomad) {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if stderr.Len() > 0 {
+		logrus.Infof("plugin %s %s: %s", filepath.Base(n.Path), method, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return fmt.Errorf("running plugin %s %s: %s", n.Path, method, err)
+	}
+
+	if err := json.Unmarshal(stdout.Bytes(), resp); err != nil {
+		return fmt.Errorf("decoding plugin %s %s response: %s", n.Path, method, err)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("plugin %s %s: %s", n.Path, method, resp.Error)
+	}
+	return nil
+}
+
+// Find looks for the named plugin in the given directories, returning the
+// path to the first match.
+func Find(name string, dirs []string) (string, bool) {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, Prefix+name)
+		if checkExecutable(path) == nil {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// Discover lists the plugins in the given directories, mapping their names to
+// their paths. Plugins in earlier directories shadow those in later ones.
+func Discover(dirs []string) (map[string]string, error) {
+	plugins := make(map[string]string)
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			name := strings.TrimPrefix(info.Name(), Prefix)
+			if name == info.Name() || name == "" {
+				continue
+			}
+			if _, ok := plugins[name]; ok {
+				continue
+			}
+			path := filepath.Join(dir, info.Name())
+			if checkExecutable(path) != nil {
+				continue
+			}
+			plugins[name] = path
+		}
+	}
+	return plugins, nil
+}
+
+func checkExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return fmt.Errorf("plugin %s is not executable", path)
+	}
+	return nil
+}
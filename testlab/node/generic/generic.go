@@ -0,0 +1,257 @@
+// Package generic implements a plugin running arbitrary processes, with the
+// exec or docker driver, configured entirely by its options.
+package generic
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
+	"github.com/libp2p/testlab/utils"
+)
+
+// Node is the struct that builds generic tasks.
+type Node struct{}
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+)
+
+// validPortLabelRegexp matches port labels usable in nomad's environment
+// variables, e.g. NOMAD_PORT_<label>.
+var validPortLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return nil
+}
+
+// Task creates a nomad task specification running the command or image given
+// by the options.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	task := napi.NewTask("generic", "exec")
+	task.Env = make(map[string]string)
+
+	res := napi.DefaultResources()
+	if mem, ok := options.Int("Memory"); ok {
+		res.MemoryMB = &mem
+	}
+	if cpu, ok := options.Int("CPU"); ok {
+		res.CPU = &cpu
+	}
+	ports, err := stringSlice(options, "Ports")
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > 0 {
+		dynamicPorts := make([]napi.Port, len(ports))
+		for i, label := range ports {
+			if !validPortLabelRegexp.MatchString(label) {
+				return nil, fmt.Errorf("port labels must consist of alpha-numeric characters and underscores, got %q", label)
+			}
+			dynamicPorts[i] = napi.Port{Label: label}
+		}
+		res.Networks = []*napi.NetworkResource{
+			&napi.NetworkResource{DynamicPorts: dynamicPorts},
+		}
+	}
+	task.Require(res)
+
+	if task.Services, err = services(options, ports); err != nil {
+		return nil, err
+	}
+	if task.Templates, err = templates(options); err != nil {
+		return nil, err
+	}
+
+	if env, ok := options.StringMap("Env"); ok {
+		for k, v := range env {
+			task.Env[k] = v
+		}
+	}
+
+	// Arguments are interpolated by nomad, e.g. ${NOMAD_PORT_<label>}.
+	args, err := stringSlice(options, "Args")
+	if err != nil {
+		return nil, err
+	}
+	fetched, err := artifact.Resolve(deployment, options, "generic")
+	if err != nil {
+		return nil, err
+	}
+	command, hasCommand := options.String("Command")
+	image, docker := options.String("Image")
+	switch {
+	case docker:
+		if fetched != nil {
+			return nil, fmt.Errorf("the Image option cannot be combined with fetched artifacts")
+		}
+		hostNetwork, _ := options.Bool("HostNetwork")
+		utils.UseDocker(task, image, command, args, hostNetwork)
+		return task, nil
+	case fetched != nil:
+		task.Artifacts = []*napi.TaskArtifact{fetched}
+		// Command is then the path of the process within the artifact.
+		if !hasCommand {
+			command = "generic"
+		}
+	case !hasCommand:
+		return nil, fmt.Errorf(`generic nodes require a "Command" or "Image" option, or a fetched artifact`)
+	}
+	task.SetConfig("command", command)
+	if len(args) > 0 {
+		task.SetConfig("args", args)
+	}
+	return task, nil
+}
+
+// stringSlice reads an optional list of strings from the options.
+func stringSlice(options utils.NodeOptions, key string) ([]string, error) {
+	if _, ok := options[key]; !ok {
+		return nil, nil
+	}
+	slice, ok := options.StringSlice(key)
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of strings", key)
+	}
+	return slice, nil
+}
+
+// services builds the consul services described by the Services option, each
+// exposing one of the given ports.
+func services(options utils.NodeOptions, ports []string) ([]*napi.Service, error) {
+	if _, ok := options["Services"]; !ok {
+		return nil, nil
+	}
+	objs, ok := options.ObjectSlice("Services")
+	if !ok {
+		return nil, fmt.Errorf("Services must be a list of objects")
+	}
+	svcs := make([]*napi.Service, len(objs))
+	for i, obj := range objs {
+		name, _ := obj.String("Name")
+		port, _ := obj.String("Port")
+		if name == "" || port == "" {
+			return nil, fmt.Errorf("services require a Name and a Port")
+		}
+		if !utils.ContainsString(ports, port) {
+			return nil, fmt.Errorf("service %s exposes port %s, which is not listed in Ports", name, port)
+		}
+		svc := &napi.Service{
+			Name:        name,
+			PortLabel:   port,
+			AddressMode: "host",
+		}
+		var err error
+		if svc.Tags, err = stringSlice(obj, "Tags"); err != nil {
+			return nil, fmt.Errorf("service %s: %s", name, err)
+		}
+		if _, ok := obj["Checks"]; ok {
+			checks, ok := obj.ObjectSlice("Checks")
+			if !ok {
+				return nil, fmt.Errorf("service %s: Checks must be a list of objects", name)
+			}
+			for _, c := range checks {
+				check, err := serviceCheck(name, c)
+				if err != nil {
+					return nil, fmt.Errorf("service %s: %s", name, err)
+				}
+				svc.Checks = append(svc.Checks, check)
+			}
+		}
+		svcs[i] = svc
+	}
+	return svcs, nil
+}
+
+// serviceCheck builds a consul check of the named service.
+func serviceCheck(service string, obj utils.NodeOptions) (napi.ServiceCheck, error) {
+	typ, _ := obj.String("Type")
+	check := napi.ServiceCheck{
+		Type:     typ,
+		Interval: defaultCheckInterval,
+		Timeout:  defaultCheckTimeout,
+	}
+	switch typ {
+	case "tcp":
+	case "http":
+		check.Path, _ = obj.String("Path")
+		if check.Path == "" {
+			check.Path = "/"
+		}
+	case "script":
+		check.Command, _ = obj.String("Command")
+		if check.Command == "" {
+			return check, fmt.Errorf("script checks require a Command")
+		}
+		var err error
+		if check.Args, err = stringSlice(obj, "Args"); err != nil {
+			return check, err
+		}
+	default:
+		return check, fmt.Errorf("unknown check type %q, expected tcp, http or script", typ)
+	}
+	check.Name, _ = obj.String("Name")
+	if check.Name == "" {
+		check.Name = fmt.Sprintf("%s %s check", service, typ)
+	}
+	for _, d := range []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"Interval", &check.Interval},
+		{"Timeout", &check.Timeout},
+	} {
+		if s, ok := obj.String(d.key); ok {
+			v, err := time.ParseDuration(s)
+			if err != nil {
+				return check, fmt.Errorf("check %s: %s", d.key, err)
+			}
+			*d.dst = v
+		}
+	}
+	return check, nil
+}
+
+// templates builds the consul templates described by the Templates option.
+func templates(options utils.NodeOptions) ([]*napi.Template, error) {
+	if _, ok := options["Templates"]; !ok {
+		return nil, nil
+	}
+	objs, ok := options.ObjectSlice("Templates")
+	if !ok {
+		return nil, fmt.Errorf("Templates must be a list of objects")
+	}
+	tmpls := make([]*napi.Template, len(objs))
+	for i, obj := range objs {
+		data, hasData := obj.String("Data")
+		dest, _ := obj.String("Destination")
+		if !hasData || dest == "" {
+			return nil, fmt.Errorf("templates require Data and a Destination")
+		}
+		tmpl := &napi.Template{
+			EmbeddedTmpl: &data,
+			DestPath:     &dest,
+		}
+		if env, ok := obj.Bool("Env"); ok {
+			tmpl.Envvars = &env
+		}
+		if mode, ok := obj.String("ChangeMode"); ok {
+			switch mode {
+			case "noop", "restart", "signal":
+			default:
+				return nil, fmt.Errorf("template %s: unknown ChangeMode %q, expected noop, restart or signal", dest, mode)
+			}
+			tmpl.ChangeMode = &mode
+		}
+		if signal, ok := obj.String("ChangeSignal"); ok {
+			tmpl.ChangeSignal = &signal
+		}
+		tmpls[i] = tmpl
+	}
+	return tmpls, nil
+}
@@ -0,0 +1,231 @@
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Node is the struct that builds IPFS (kubo) daemon tasks.
+type Node struct{}
+
+// Names of the consul services registered by each daemon. The swarm is exposed
+// as the libp2p service, so that links and partitions apply to it.
+const (
+	SwarmServiceName   = "libp2p"
+	APIServiceName     = "ipfs-api"
+	GatewayServiceName = "ipfs-gateway"
+)
+
+const defaultPostDeployParallelism = 16
+
+// Task creates a nomad task specification for a kubo daemon.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	task := napi.NewTask("ipfs", "exec")
+	command := "/usr/local/bin/ipfs"
+
+	res := napi.DefaultResources()
+	res.Networks = []*napi.NetworkResource{
+		&napi.NetworkResource{
+			DynamicPorts: []napi.Port{
+				napi.Port{Label: "libp2p"},
+				napi.Port{Label: "api"},
+				napi.Port{Label: "gateway"},
+			},
+		},
+	}
+	if mem, ok := options.Int("Memory"); ok {
+		res.MemoryMB = &mem
+	}
+	task.Require(res)
+
+	task.Services = append(task.Services,
+		&napi.Service{
+			Name:        SwarmServiceName,
+			PortLabel:   "libp2p",
+			AddressMode: "host",
+		},
+		&napi.Service{
+			Name:        APIServiceName,
+			PortLabel:   "api",
+			AddressMode: "host",
+		},
+		&napi.Service{
+			Name:        GatewayServiceName,
+			PortLabel:   "gateway",
+			AddressMode: "host",
+		},
+	)
+
+	fetched, err := artifact.Resolve(deployment, options, "ipfs")
+	if err != nil {
+		return nil, err
+	}
+	if fetched != nil {
+		task.Artifacts = []*napi.TaskArtifact{fetched}
+		// Fetched binaries live in the task directory.
+		command = "ipfs"
+	}
+	if !filepath.IsAbs(command) {
+		command = fmt.Sprintf("${NOMAD_TASK_DIR}/../%s", command)
+	}
+
+	if tags, ok := options.StringSlice("Tags"); ok {
+		for _, service := range task.Services {
+			service.Tags = tags
+		}
+	}
+
+	profile, _ := options.String("Profile")
+
+	if bootstrap, ok := options.String("BootstrapDeployment"); ok {
+		tmpl := `BOOTSTRAP_PEERS={{range $index, $service := service "%s.%s"}}{{if ne $index 0}},{{end}}/ip4/{{$service.Address}}/tcp/{{$service.Port}}/p2p/{{printf "%s/ip4/%%s/tcp/%%d" $service.Address $service.Port | key}}{{end}}`
+		tmpl = fmt.Sprintf(tmpl, utils.DeploymentTag(deployment.RunID, bootstrap), deployment.ServiceName(SwarmServiceName), deployment.Key("peerids"))
+		env := true
+		task.Templates = append(task.Templates, &napi.Template{
+			EmbeddedTmpl: &tmpl,
+			DestPath:     utils.StringPtr("bootstrap_peers.env"),
+			Envvars:      &env,
+		})
+	}
+
+	script := startScript
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &script,
+		DestPath:     utils.StringPtr("local/ipfs.sh"),
+	})
+	task.SetConfig("command", "/bin/sh")
+	task.SetConfig("args", []string{"local/ipfs.sh", command, profile})
+
+	return task, nil
+}
+
+// startScript initializes a repository in the task directory, listening on
+// the task's ports and bootstrapping only from $BOOTSTRAP_PEERS, then runs
+// the daemon.
+const startScript = `#!/bin/sh
+set -e
+IPFS="$1"
+PROFILE="$2"
+export IPFS_PATH="$NOMAD_TASK_DIR/ipfs"
+
+if [ ! -f "$IPFS_PATH/config" ]; then
+  if [ -n "$PROFILE" ]; then
+    "$IPFS" init --profile="$PROFILE"
+  else
+    "$IPFS" init
+  fi
+fi
+
+"$IPFS" config --json Addresses.Swarm "[\"/ip4/$NOMAD_IP_libp2p/tcp/$NOMAD_PORT_libp2p\"]"
+"$IPFS" config Addresses.API "/ip4/$NOMAD_IP_api/tcp/$NOMAD_PORT_api"
+"$IPFS" config Addresses.Gateway "/ip4/$NOMAD_IP_gateway/tcp/$NOMAD_PORT_gateway"
+"$IPFS" bootstrap rm --all
+for peer in $(echo "$BOOTSTRAP_PEERS" | tr ',' ' '); do
+  "$IPFS" bootstrap add "$peer"
+done
+
+exec "$IPFS" daemon
+`
+
+// PostDeploy records the peer ID of every daemon in the deployment in the
+// run's KV namespace, under each of its swarm addresses, like the p2pd plugin.
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return forEachDaemon(ctx, consul, deployment, options, func(apiAddr string) error {
+		id, addrs, err := identify(ctx, apiAddr)
+		if err != nil {
+			return err
+		}
+		for _, addr := range addrs {
+			kv := &capi.KVPair{
+				Key:   deployment.Key("peerids", addr),
+				Value: []byte(id),
+			}
+			if _, err := consul.KV().Put(kv, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// forEachDaemon calls fn concurrently with the API address of every daemon of
+// the deployment, retrying failed calls.
+func forEachDaemon(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions, fn func(string) error) error {
+	tag := utils.DeploymentTag(deployment.RunID, deployment.Deployment)
+	svcs, _, err := consul.Catalog().Service(deployment.ServiceName(APIServiceName), tag, nil)
+	if err != nil {
+		return err
+	}
+	if len(svcs) == 0 {
+		logrus.Infof("no %s services found for %s", APIServiceName, deployment.Deployment)
+		return nil
+	}
+	apiAddrs := make([]string, len(svcs))
+	for i, svc := range svcs {
+		apiAddrs[i] = fmt.Sprintf("%s:%d", svc.ServiceAddress, svc.ServicePort)
+	}
+
+	parallelism := defaultPostDeployParallelism
+	if p, ok := options.Int("PostDeployParallelism"); ok {
+		parallelism = p
+	}
+	backoff := utils.DefaultBackoff
+	if attempts, ok := options.Int("PostDeployAttempts"); ok {
+		backoff.Attempts = attempts
+	}
+
+	return utils.ForEach(ctx, parallelism, apiAddrs, func(ctx context.Context, apiAddr string) error {
+		return utils.Retry(ctx, backoff, func() error {
+			return fn(apiAddr)
+		})
+	})
+}
+
+type idResponse struct {
+	ID        string
+	Addresses []string
+}
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// identify asks the daemon whose API listens on the given address for its
+// peer ID and its addresses, stripped of their trailing peer ID.
+func identify(ctx context.Context, apiAddr string) (string, []string, error) {
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/api/v0/id", apiAddr), nil)
+	if err != nil {
+		return "", nil, err
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("identifying %s: %s", apiAddr, resp.Status)
+	}
+	var id idResponse
+	if err := json.NewDecoder(resp.Body).Decode(&id); err != nil {
+		return "", nil, err
+	}
+	addrs := make([]string, 0, len(id.Addresses))
+	for _, addr := range id.Addresses {
+		for _, suffix := range []string{"/p2p/", "/ipfs/"} {
+			if i := strings.Index(addr, suffix); i >= 0 {
+				addr = addr[:i]
+			}
+		}
+		addrs = append(addrs, addr)
+	}
+	return id.ID, addrs, nil
+}
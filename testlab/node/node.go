@@ -1,40 +1,86 @@
 package node
 
 import (
+	"context"
 	"fmt"
 
 	capi "github.com/hashicorp/consul/api"
 	napi "github.com/hashicorp/nomad/api"
-	"github.com/libp2p/testlab/testlab/node/p2pd"
-	"github.com/libp2p/testlab/testlab/node/prometheus"
-	"github.com/libp2p/testlab/testlab/node/scenario"
 	"github.com/libp2p/testlab/utils"
 )
 
-var Plugins map[string]Node
+// PostDeployFunc runs a deployment's post deploy hooks.
+type PostDeployFunc func(context.Context, *capi.Client) error
 
-func GetPlugin(name string) (Node, error) {
-	plugin, ok := Plugins[name]
-	if !ok {
-		return nil, fmt.Errorf("plugin \"%s\" not registered", name)
-	}
-	return plugin, nil
+// Node is an incredibly simple interface describing plugins that will generate
+// nomad tasks. For now, this is left as an interface so plugin implementors can
+// include instantiation logic. Both methods are passed the context of the
+// deployment they are called for. PostDeploy should give up once its context
+// is cancelled.
+type Node interface {
+	Task(*utils.DeploymentContext, utils.NodeOptions) (*napi.Task, error)
+	PostDeploy(context.Context, *capi.Client, *utils.DeploymentContext, utils.NodeOptions) error
 }
 
-func init() {
-	Plugins = map[string]Node{
-		"p2pd":       new(p2pd.Node),
-		"scenario":   new(scenario.Node),
-		"prometheus": new(prometheus.Node),
-	}
+// PreDestroyer is implemented by plugins that need to clean up while their
+// deployment is still running. PreDestroy is called by testlab stop before the
+// deployment's jobs are deregistered.
+type PreDestroyer interface {
+	PreDestroy(context.Context, *capi.Client, *utils.DeploymentContext, utils.NodeOptions) error
 }
 
-type PostDeployFunc func(*capi.Client) error
+// PostDestroyer is implemented by plugins that need to clean up once their
+// deployment is gone. PostDestroy is called by testlab stop once the
+// deployment's services have been deregistered from consul.
+type PostDestroyer interface {
+	PostDestroy(context.Context, *capi.Client, *utils.DeploymentContext, utils.NodeOptions) error
+}
 
-// Node is an incredibly simple interface describing plugins that will generate
-// nomad tasks. For now, this is left as an interface so plugin implementors can
-// include instantiation logic.
-type Node interface {
-	Task(utils.NodeOptions) (*napi.Task, error)
-	PostDeploy(*capi.Client, utils.NodeOptions) error
+// Variant is a share of a deployment's instances run with their own options.
+type Variant struct {
+	// Name distinguishes the variant's task groups from those of the
+	// deployment's other variants.
+	Name string
+	// Weight is the variant's share of the deployment's instances, relative to
+	// the weights of the other variants.
+	Weight float64
+	// Options are the plugin options the variant's tasks are generated with.
+	Options utils.NodeOptions
+}
+
+// Splitter is implemented by plugins that split a deployment's instances into
+// weighted variants, e.g. running different versions of a binary. Each variant
+// gets its own task groups, and its tasks are generated with its options.
+// Returning no variants leaves the deployment whole.
+type Splitter interface {
+	Variants(utils.NodeOptions) ([]*Variant, error)
+}
+
+// MultiTaskNode is implemented by plugins that generate several tasks per task
+// group, such as a daemon alongside its log shipper. When implemented, Tasks is
+// called instead of Task, and the first task returned is considered the
+// group's main task.
+type MultiTaskNode interface {
+	Node
+	Tasks(*utils.DeploymentContext, utils.NodeOptions) ([]*napi.Task, error)
+}
+
+// Tasks generates the tasks of the given plugin, whether or not it implements
+// MultiTaskNode.
+func Tasks(plugin Node, deployment *utils.DeploymentContext, options utils.NodeOptions) ([]*napi.Task, error) {
+	if multi, ok := plugin.(MultiTaskNode); ok {
+		tasks, err := multi.Tasks(deployment, options)
+		if err != nil {
+			return nil, err
+		}
+		if len(tasks) == 0 {
+			return nil, fmt.Errorf("plugin generated no tasks for deployment %s", deployment.Deployment)
+		}
+		return tasks, nil
+	}
+	task, err := plugin.Task(deployment, options)
+	if err != nil {
+		return nil, err
+	}
+	return []*napi.Task{task}, nil
 }
@@ -0,0 +1,52 @@
+package p2pd
+
+import (
+	"fmt"
+	"time"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+)
+
+// addChecks registers consul checks on the task's services, so that crashed
+// or wedged daemons drop out of service discovery. The libp2p service is only
+// checked when the daemon listens on the host, as it cannot be reached from
+// the host behind a NAT.
+func addChecks(task *napi.Task, nat bool, options utils.NodeOptions) error {
+	interval := defaultCheckInterval
+	if s, ok := options.String("CheckInterval"); ok {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("CheckInterval: %s", err)
+		}
+		interval = d
+	}
+	timeout := defaultCheckTimeout
+	if timeout > interval {
+		timeout = interval
+	}
+	for _, service := range task.Services {
+		check := napi.ServiceCheck{
+			Name:     fmt.Sprintf("%s port alive", service.Name),
+			Type:     "tcp",
+			Interval: interval,
+			Timeout:  timeout,
+		}
+		switch service.Name {
+		case "metrics":
+			check.Type = "http"
+			check.Path = "/metrics"
+		case "libp2p":
+			if nat {
+				continue
+			}
+		}
+		service.Checks = append(service.Checks, check)
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package p2pd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/testlab/utils"
+)
+
+// DeriveKey derives the private key of the index-th instance of a deployment
+// from the seed given in its Identity option.
+func DeriveKey(seed string, index int) (crypto.PrivKey, error) {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", seed, index)))
+	priv, _, err := crypto.GenerateEd25519Key(bytes.NewReader(sum[:]))
+	return priv, err
+}
+
+// identityKeys returns the marshalled private keys of the instances of the
+// deployment, in order, as configured by the Identity option. It returns nil
+// if the option is unset.
+func identityKeys(quantity int, options utils.NodeOptions) ([][]byte, error) {
+	identity, ok := options.Object("Identity")
+	if !ok {
+		return nil, nil
+	}
+	seed, hasSeed := identity.String("Seed")
+	files, hasFiles := identity.StringSlice("Keys")
+	if hasSeed == hasFiles {
+		return nil, fmt.Errorf("Identity requires exactly one of Seed and Keys")
+	}
+
+	keys := make([][]byte, quantity)
+	if hasFiles {
+		if len(files) < quantity {
+			return nil, fmt.Errorf("Identity has %d keys for %d instances", len(files), quantity)
+		}
+		for i := range keys {
+			bs, err := ioutil.ReadFile(files[i])
+			if err != nil {
+				return nil, err
+			}
+			if _, err := crypto.UnmarshalPrivateKey(bs); err != nil {
+				return nil, fmt.Errorf("identity key %s: %s", files[i], err)
+			}
+			keys[i] = bs
+		}
+		return keys, nil
+	}
+
+	for i := range keys {
+		priv, err := DeriveKey(seed, i)
+		if err != nil {
+			return nil, err
+		}
+		if keys[i], err = crypto.MarshalPrivateKey(priv); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// PeerIDs returns the peer IDs of every instance of the deployment, in order,
+// if they are fixed by its Identity option, or nil otherwise.
+func PeerIDs(deployment *utils.DeploymentContext, options utils.NodeOptions) ([]peer.ID, error) {
+	keys, err := identityKeys(deployment.Quantity, options)
+	if err != nil || keys == nil {
+		return nil, err
+	}
+	ids := make([]peer.ID, len(keys))
+	for i, bs := range keys {
+		priv, err := crypto.UnmarshalPrivateKey(bs)
+		if err != nil {
+			return nil, err
+		}
+		if ids[i], err = peer.IDFromPrivateKey(priv); err != nil {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// identityTemplate renders the key of the group's instance running the task,
+// picked by its allocation index among the group's keys.
+const identityTemplate = "{{ with $keys := parseJSON `%s` }}{{ index $keys (env \"NOMAD_ALLOC_INDEX\" | parseInt) | base64Decode }}{{ end }}"
+
+// addIdentity delivers the keys of the task group's instances to the task,
+// returning the daemon flags loading them, or nil if the Identity option is
+// unset.
+func addIdentity(task *napi.Task, deployment *utils.DeploymentContext, options utils.NodeOptions) ([]string, error) {
+	path, err := IdentityFile(task, deployment, options)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	return []string{"-id", path}, nil
+}
+
+// IdentityFile delivers the marshalled private key of each of the task
+// group's instances, as configured by the Identity option, to the task,
+// returning the path the key is rendered at, or an empty string if the option
+// is unset. Other plugins can use it to give their tasks fixed identities.
+func IdentityFile(task *napi.Task, deployment *utils.DeploymentContext, options utils.NodeOptions) (string, error) {
+	keys, err := identityKeys(deployment.Quantity, options)
+	if err != nil || keys == nil {
+		return "", err
+	}
+	count := deployment.Count
+	if count == 0 {
+		count = deployment.Quantity
+	}
+	if deployment.Offset+count > len(keys) {
+		return "", fmt.Errorf("Identity has %d keys, but the task group ends at instance %d", len(keys), deployment.Offset+count)
+	}
+
+	encoded := make([]string, count)
+	for i := range encoded {
+		encoded[i] = base64.StdEncoding.EncodeToString(keys[deployment.Offset+i])
+	}
+	bs, err := json.Marshal(encoded)
+	if err != nil {
+		return "", err
+	}
+	tmpl := fmt.Sprintf(identityTemplate, bs)
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &tmpl,
+		DestPath:     utils.StringPtr("secrets/identity.key"),
+		Perms:        utils.StringPtr("0600"),
+	})
+	return "${NOMAD_SECRETS_DIR}/identity.key", nil
+}
+
+// recordsPeerIDs reports whether the post deploy hook should identify every
+// daemon and record its peer ID under its addresses. It is the default unless
+// peer IDs are fixed by the Identity option, in which case they are recorded
+// under the addresses of the daemons' libp2p services instead.
+func recordsPeerIDs(options utils.NodeOptions) bool {
+	if record, ok := options.Bool("RecordPeerIDs"); ok {
+		return record
+	}
+	_, fixed := options.Object("Identity")
+	return !fixed
+}
+
+// listens reports whether the daemon listens for peers, and registers a
+// libp2p service.
+func listens(options utils.NodeOptions) bool {
+	undialable, _ := options.Bool("Undialable")
+	_, nat := options.String("NAT")
+	return undialable || nat
+}
+
+// identityKey is the KV key under which the peer ID of the index-th instance
+// of a deployment with fixed identities is recorded.
+func identityKey(deployment *utils.DeploymentContext, index int) string {
+	return deployment.Key("identities", deployment.Deployment, strconv.Itoa(index))
+}
+
+// InstanceTagPrefix prefixes the tag identifying the instance behind each
+// service of a deployment with fixed identities. Nomad interpolates the
+// allocation index, which is relative to the task group, so the tag also holds
+// the group's offset within the deployment.
+const InstanceTagPrefix = "instance-"
+
+// InstanceTag returns the tag identifying the instance registering a service,
+// for the task groups of the given deployment.
+func InstanceTag(deployment *utils.DeploymentContext) string {
+	return fmt.Sprintf("%s%d-${NOMAD_ALLOC_INDEX}", InstanceTagPrefix, deployment.Offset)
+}
+
+// InstanceIndex returns the index, within its deployment, of the instance
+// registering a service with the given tags.
+func InstanceIndex(tags []string) (int, error) {
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, InstanceTagPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(tag, InstanceTagPrefix), "-", 2)
+		if len(parts) != 2 {
+			break
+		}
+		offset, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+		index, err := strconv.Atoi(parts[1])
+		if err != nil {
+			break
+		}
+		return offset + index, nil
+	}
+	return 0, fmt.Errorf("service has no valid instance tag among %v", tags)
+}
+
+// RecordIdentities waits for every instance of the deployment to register the
+// named service, tagged with InstanceTag, then records the peer ID of each
+// instance under the service's address, as the daemons' post deploy hook
+// does, without contacting them.
+func RecordIdentities(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, service string, ids []peer.ID) error {
+	tag := utils.DeploymentTag(deployment.RunID, deployment.Deployment)
+	var svcs []*capi.CatalogService
+	err := utils.Retry(ctx, utils.DefaultBackoff, func() error {
+		var err error
+		svcs, _, err = consul.Catalog().Service(deployment.ServiceName(service), tag, nil)
+		if err != nil {
+			return err
+		}
+		if len(svcs) < deployment.Quantity {
+			return fmt.Errorf("%d of %d %s services registered", len(svcs), deployment.Quantity, service)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, svc := range svcs {
+		index, err := InstanceIndex(svc.ServiceTags)
+		if err != nil {
+			return fmt.Errorf("%s service: %s", service, err)
+		}
+		if index >= len(ids) {
+			return fmt.Errorf("instance %d has no identity", index)
+		}
+		kv := &capi.KVPair{
+			Key:   deployment.Key("peerids", "ip4", svc.ServiceAddress, "tcp", strconv.Itoa(svc.ServicePort)),
+			Value: []byte(ids[index].Pretty()),
+		}
+		if _, err := consul.KV().Put(kv, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package p2pd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	crypto "github.com/libp2p/go-libp2p-crypto"
+	peer "github.com/libp2p/go-libp2p-peer"
+	"github.com/libp2p/testlab/utils"
+)
+
+func TestDeriveKey(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		seed   string
+		index  int
+		other  string
+		oindex int
+		same   bool
+	}{
+		{"deterministic", "run", 0, "run", 0, true},
+		{"deterministic at index", "run", 7, "run", 7, true},
+		{"index", "run", 0, "run", 1, false},
+		{"seed", "run", 0, "other", 0, false},
+		// The seed and index are separated, so that seed "a1" at index 0
+		// differs from seed "a" at index 10.
+		{"separated", "a1", 0, "a", 10, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := DeriveKey(tc.seed, tc.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := DeriveKey(tc.other, tc.oindex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Type() != crypto.Ed25519 {
+				t.Fatalf("expected an Ed25519 key, got type %d", a.Type())
+			}
+			if a.Equals(b) != tc.same {
+				t.Fatalf("DeriveKey(%q, %d) and DeriveKey(%q, %d): expected equal to be %t", tc.seed, tc.index, tc.other, tc.oindex, tc.same)
+			}
+		})
+	}
+}
+
+// writeKeys marshals the given keys into files in a temporary directory,
+// returning their paths.
+func writeKeys(t *testing.T, keys ...crypto.PrivKey) ([]interface{}, func()) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := make([]interface{}, len(keys))
+	for i, key := range keys {
+		bs, err := crypto.MarshalPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("key%d", i))
+		if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths[i] = path
+	}
+	return paths, func() { os.RemoveAll(dir) }
+}
+
+func TestPeerIDs(t *testing.T) {
+	derived := make([]crypto.PrivKey, 3)
+	expected := make([]peer.ID, 3)
+	for i := range derived {
+		var err error
+		if derived[i], err = DeriveKey("seed", i); err != nil {
+			t.Fatal(err)
+		}
+		if expected[i], err = peer.IDFromPrivateKey(derived[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, cleanup := writeKeys(t, derived...)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		quantity int
+		identity utils.NodeOptions
+		expected []peer.ID
+		fails    bool
+	}{
+		{name: "unset", quantity: 3},
+		{name: "seed", quantity: 3, identity: utils.NodeOptions{"Seed": "seed"}, expected: expected},
+		{name: "seed prefix", quantity: 2, identity: utils.NodeOptions{"Seed": "seed"}, expected: expected[:2]},
+		{name: "keys", quantity: 3, identity: utils.NodeOptions{"Keys": files}, expected: expected},
+		{name: "more keys than instances", quantity: 1, identity: utils.NodeOptions{"Keys": files}, expected: expected[:1]},
+		{name: "too few keys", quantity: 4, identity: utils.NodeOptions{"Keys": files}, fails: true},
+		{name: "missing key", quantity: 1, identity: utils.NodeOptions{"Keys": []interface{}{"/nonexistent/key"}}, fails: true},
+		{name: "seed and keys", quantity: 3, identity: utils.NodeOptions{"Seed": "seed", "Keys": files}, fails: true},
+		{name: "neither", quantity: 3, identity: utils.NodeOptions{}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := utils.NodeOptions{}
+			if tc.identity != nil {
+				options["Identity"] = tc.identity
+			}
+			deployment := &utils.DeploymentContext{Deployment: "peers", Quantity: tc.quantity}
+			ids, err := PeerIDs(deployment, options)
+			if tc.fails {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ids) != len(tc.expected) {
+				t.Fatalf("expected %d peer IDs, got %d", len(tc.expected), len(ids))
+			}
+			for i := range ids {
+				if ids[i] != tc.expected[i] {
+					t.Fatalf("peer ID %d: expected %s, got %s", i, tc.expected[i].Pretty(), ids[i].Pretty())
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceIndex(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		tags     []string
+		expected int
+		fails    bool
+	}{
+		{name: "first group", tags: []string{"instance-0-3"}, expected: 3},
+		{name: "offset group", tags: []string{"relay", "instance-8-2"}, expected: 10},
+		{name: "no tag", tags: []string{"relay"}, fails: true},
+		{name: "uninterpolated", tags: []string{"instance-0-${NOMAD_ALLOC_INDEX}"}, fails: true},
+		{name: "malformed", tags: []string{"instance-3"}, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			index, err := InstanceIndex(tc.tags)
+			if tc.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got index %d", index)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if index != tc.expected {
+				t.Fatalf("expected index %d, got %d", tc.expected, index)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package p2pd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// Daemon implementations supported by the Implementation option.
+const (
+	// Go is the go-libp2p-daemon, the reference implementation whose flags the
+	// js dialect is translated from.
+	Go = "go"
+	// JS is the js-libp2p-daemon, provisioned with npm unless a prebuilt
+	// tarball is fetched.
+	JS = "js"
+)
+
+// flag describes a daemon flag as understood by the go daemon.
+type flag struct {
+	// value is set for flags taking a separate value.
+	value bool
+}
+
+// goFlags lists every flag the plugin passes to the daemon, in the go dialect,
+// all of which PinnedVersion has.
+var goFlags = map[string]flag{
+	"-listen":                         {value: true},
+	"-hostAddrs":                      {value: true},
+	"-announceAddrs":                  {value: true},
+	"-metricsAddr":                    {value: true},
+	"-noListenAddrs":                  {},
+	"-pubsub":                         {},
+	"-pubsubRouter":                   {value: true},
+	"-b":                              {},
+	"-bootstrapPeers":                 {value: true},
+	"-id":                             {value: true},
+	"-dht":                            {},
+	"-dhtClient":                      {},
+	"-connManager":                    {},
+	"-connLo":                         {value: true},
+	"-connHi":                         {value: true},
+	"-connGrace":                      {value: true},
+	"-relay":                          {},
+	"-relayHop":                       {},
+	"-relayActive":                    {},
+	"-relayDiscovery":                 {},
+	"-pubsubSign":                     {},
+	"-pubsubSignStrict":               {},
+	"-gossipsubHeartbeatInterval":     {value: true},
+	"-gossipsubHeartbeatInitialDelay": {value: true},
+	"-autonat":                        {},
+	"-quic":                           {},
+	"-autoRelay":                      {},
+}
+
+// implementation describes how to obtain and invoke a daemon implementation.
+type implementation struct {
+	// command is the daemon's default location on the nomad clients, if it is
+	// expected to be installed there.
+	command string
+	// entrypoint is the daemon's location within a fetched artifact.
+	entrypoint string
+	// flags translates go flags to this implementation's dialect. Flags
+	// missing from the table are passed through, flags mapped to an empty
+	// string are unsupported and dropped.
+	flags map[string]string
+	// npm is the default package to install the daemon from, if it can be
+	// installed with npm.
+	npm string
+}
+
+var implementations = map[string]*implementation{
+	Go: {
+		command:    "/usr/local/bin/p2pd",
+		entrypoint: "p2pd",
+	},
+	JS: {
+		entrypoint: "p2pd/bin/jsp2pd",
+		npm:        "libp2p-daemon",
+		flags: map[string]string{
+			"-listen":                         "--listen",
+			"-hostAddrs":                      "--hostAddrs",
+			"-announceAddrs":                  "--announceAddrs",
+			"-metricsAddr":                    "",
+			"-noListenAddrs":                  "",
+			"-pubsub":                         "--pubsub",
+			"-pubsubRouter":                   "--pubsubRouter",
+			"-b":                              "--bootstrap",
+			"-bootstrapPeers":                 "--bootstrapPeers",
+			"-id":                             "--id",
+			"-dht":                            "--dht",
+			"-dhtClient":                      "--dhtClient",
+			"-connManager":                    "--connMgr",
+			"-connLo":                         "--connMgrLo",
+			"-connHi":                         "--connMgrHi",
+			"-connGrace":                      "",
+			"-relay":                          "",
+			"-relayHop":                       "",
+			"-relayActive":                    "",
+			"-relayDiscovery":                 "",
+			"-pubsubSign":                     "",
+			"-pubsubSignStrict":               "",
+			"-gossipsubHeartbeatInterval":     "",
+			"-gossipsubHeartbeatInitialDelay": "",
+			"-autonat":                        "",
+			"-quic":                           "",
+			"-autoRelay":                      "",
+		},
+	},
+}
+
+func lookupImplementation(name string) (*implementation, error) {
+	impl, ok := implementations[name]
+	if !ok {
+		names := make([]string, 0, len(implementations))
+		for n := range implementations {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown p2pd implementation %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return impl, nil
+}
+
+// supports reports whether the implementation understands the given go flag.
+func (impl *implementation) supports(goFlag string) bool {
+	translated, ok := impl.flags[goFlag]
+	return !ok || translated != ""
+}
+
+// translate rewrites go daemon arguments into the implementation's dialect,
+// dropping unsupported flags along with their values.
+func (impl *implementation) translate(args []string) []string {
+	translated := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		goName := flagName(arg)
+		f, known := goFlags[goName]
+		if !known {
+			translated = append(translated, arg)
+			continue
+		}
+		name, ok := impl.flags[goName]
+		if !ok {
+			name = goName
+		}
+		inline := arg != goName
+		if name == "" {
+			logrus.Warnf("p2pd implementation does not support %s, ignoring it", goName)
+			if f.value && !inline {
+				i++
+			}
+			continue
+		}
+		translated = append(translated, name+strings.TrimPrefix(arg, goName))
+		if f.value && !inline && i+1 < len(args) {
+			i++
+			translated = append(translated, args[i])
+		}
+	}
+	return translated
+}
+
+// provision sets up the task to obtain the daemon, from the given artifact,
+// with npm or from the nomad clients, returning the command that runs it and
+// any arguments to prepend to the daemon's own.
+func (impl *implementation) provision(task *napi.Task, fetched *napi.TaskArtifact, options utils.NodeOptions) (string, []string, error) {
+	if fetched != nil {
+		task.Artifacts = append(task.Artifacts, fetched)
+		entrypoint := impl.entrypoint
+		if e, ok := options.String("Entrypoint"); ok {
+			entrypoint = e
+		}
+		return entrypoint, nil, nil
+	}
+
+	pkg, ok := options.String("Package")
+	if impl.npm == "" {
+		if ok {
+			return "", nil, fmt.Errorf("this p2pd implementation cannot be installed with npm")
+		}
+		if impl.command == "" {
+			return "", nil, fmt.Errorf("this p2pd implementation must be fetched with the Build, Path, Fetch or Cid option")
+		}
+		return impl.command, nil, nil
+	}
+	if !ok {
+		pkg = impl.npm
+	}
+
+	script := npmScript
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &script,
+		DestPath:     utils.StringPtr("local/npm.sh"),
+	})
+	return "/bin/sh", []string{"${NOMAD_TASK_DIR}/npm.sh", pkg}, nil
+}
+
+// npmScript installs the given npm package in the task directory and runs the
+// jsp2pd binary it provides with the remaining arguments.
+const npmScript = `#!/bin/sh
+set -e
+PREFIX="$NOMAD_TASK_DIR/npm"
+npm install --no-save --prefix "$PREFIX" "$1" >&2
+shift
+exec "$PREFIX/node_modules/.bin/jsp2pd" "$@"
+`
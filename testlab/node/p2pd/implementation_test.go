@@ -0,0 +1,87 @@
+package p2pd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTranslate(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		impl     string
+		args     []string
+		expected []string
+	}{
+		{
+			name:     "go passes through",
+			impl:     Go,
+			args:     []string{"-listen", "/ip4/0.0.0.0/tcp/1", "-dht", "-connLo", "10", "-relay=false"},
+			expected: []string{"-listen", "/ip4/0.0.0.0/tcp/1", "-dht", "-connLo", "10", "-relay=false"},
+		},
+		{
+			name:     "js renames",
+			impl:     JS,
+			args:     []string{"-listen", "/ip4/0.0.0.0/tcp/1", "-b", "-bootstrapPeers", "/ip4/1.2.3.4/tcp/2", "-dhtClient"},
+			expected: []string{"--listen", "/ip4/0.0.0.0/tcp/1", "--bootstrap", "--bootstrapPeers", "/ip4/1.2.3.4/tcp/2", "--dhtClient"},
+		},
+		{
+			name:     "js drops unsupported flags and their values",
+			impl:     JS,
+			args:     []string{"-metricsAddr", "0.0.0.0:1", "-pubsub", "-connGrace", "30s", "-autonat", "-autoRelay"},
+			expected: []string{"--pubsub"},
+		},
+		{
+			name:     "js drops unsupported inline values",
+			impl:     JS,
+			args:     []string{"-pubsubSign=true", "-relay=false", "-pubsub"},
+			expected: []string{"--pubsub"},
+		},
+		{
+			name:     "js keeps inline values of renamed flags",
+			impl:     JS,
+			args:     []string{"-connLo=10", "-connHi", "20"},
+			expected: []string{"--connMgrLo=10", "--connMgrHi", "20"},
+		},
+		{
+			name:     "unknown flags pass through",
+			impl:     JS,
+			args:     []string{"--custom", "value"},
+			expected: []string{"--custom", "value"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			impl, err := lookupImplementation(tc.impl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			translated := impl.translate(tc.args)
+			if !reflect.DeepEqual(translated, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, translated)
+			}
+		})
+	}
+}
+
+func TestSupports(t *testing.T) {
+	for _, tc := range []struct {
+		impl     string
+		flag     string
+		expected bool
+	}{
+		{Go, "-autoRelay", true},
+		{Go, "-metricsAddr", true},
+		{JS, "-dht", true},
+		{JS, "-autoRelay", false},
+		{JS, "-metricsAddr", false},
+	} {
+		t.Run(tc.impl+tc.flag, func(t *testing.T) {
+			impl, err := lookupImplementation(tc.impl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if supported := impl.supports(tc.flag); supported != tc.expected {
+				t.Fatalf("expected supports(%s) to be %t", tc.flag, tc.expected)
+			}
+		})
+	}
+}
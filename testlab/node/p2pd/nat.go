@@ -0,0 +1,176 @@
+package p2pd
+
+import (
+	"fmt"
+	"path/filepath"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+// NAT types supported by the NAT option.
+const (
+	// FullCone maps the daemon's libp2p port to the same port on the host,
+	// accepting inbound connections from anyone.
+	FullCone = "full-cone"
+	// Restricted maps the daemon's libp2p port to the same port on the host,
+	// only accepting inbound traffic from endpoints the daemon has contacted.
+	Restricted = "restricted"
+	// Symmetric maps every outbound connection to a random port on the host,
+	// only accepting inbound traffic on established connections.
+	Symmetric = "symmetric"
+)
+
+// NATTaskName is the name of the task setting up the NAT of daemons placed
+// behind one, alongside the daemon's task.
+const NATTaskName = "nat"
+
+// natTasks rewrites the given task so that the daemon runs in its own network
+// namespace, behind an emulated NAT of the given type, and returns it along
+// with the nat task setting up the namespace. The daemon's control and metrics
+// ports remain reachable on the host's address. The daemon replaces the shell
+// waiting for its namespace, so that signals sent to its task reach it. This
+// requires the raw_exec driver.
+func natTasks(task *napi.Task, natType, command string, args []string) ([]*napi.Task, error) {
+	switch natType {
+	case FullCone, Restricted, Symmetric:
+	default:
+		return nil, fmt.Errorf("unknown NAT type %q, expected one of %s, %s or %s", natType, FullCone, Restricted, Symmetric)
+	}
+
+	// Fetched binaries live in the task directory, which raw_exec does not
+	// put on the PATH.
+	if !filepath.IsAbs(command) {
+		command = fmt.Sprintf("${NOMAD_TASK_DIR}/../%s", command)
+	}
+
+	wrapper := natExecScript
+	task.Driver = "raw_exec"
+	// Stopping the daemon stops the nat task, which tears the NAT down.
+	task.Leader = true
+	task.Templates = append(task.Templates, &napi.Template{
+		EmbeddedTmpl: &wrapper,
+		DestPath:     utils.StringPtr("local/nat-exec.sh"),
+	})
+	task.SetConfig("command", "/bin/sh")
+	task.SetConfig("args", append([]string{"local/nat-exec.sh", command}, args...))
+
+	nat := napi.NewTask(NATTaskName, "raw_exec")
+	nat.Env = map[string]string{
+		"NAT_TYPE":      natType,
+		"HOST_IP":       fmt.Sprintf("${NOMAD_IP_%s_libp2p}", task.Name),
+		"LIBP2P_PORT":   fmt.Sprintf("${NOMAD_PORT_%s_libp2p}", task.Name),
+		"FORWARD_PORTS": fmt.Sprintf("${NOMAD_PORT_%s_p2pd} ${NOMAD_PORT_%s_metrics}", task.Name, task.Name),
+	}
+	script := natScript
+	nat.Templates = append(nat.Templates, &napi.Template{
+		EmbeddedTmpl: &script,
+		DestPath:     utils.StringPtr("local/nat.sh"),
+	})
+	nat.SetConfig("command", "/bin/sh")
+	nat.SetConfig("args", []string{"local/nat.sh"})
+
+	res := napi.DefaultResources()
+	cpu := 20
+	res.CPU = &cpu
+	memory := 16
+	res.MemoryMB = &memory
+	nat.Require(res)
+
+	return []*napi.Task{task, nat}, nil
+}
+
+// natExecScript waits for the nat task to set up the daemon's namespace, then
+// replaces itself with the daemon, run in the namespace.
+const natExecScript = `#!/bin/sh
+NS="testlab-$(echo "$NOMAD_ALLOC_ID" | cut -c1-8)"
+while [ ! -e "$NOMAD_ALLOC_DIR/nat.ready" ]; do
+  sleep 1
+done
+exec ip netns exec "$NS" "$@"
+`
+
+// natScript sets up the daemon's namespace and NAT rules, then waits to be
+// stopped to remove them.
+const natScript = `#!/bin/sh
+set -e
+READY="$NOMAD_ALLOC_DIR/nat.ready"
+rm -f "$READY"
+
+# Dynamic ports are unique per host, so derive the namespace's interfaces and
+# its /30 subnet from the libp2p port.
+NS="testlab-$(echo "$NOMAD_ALLOC_ID" | cut -c1-8)"
+HOST_IF="tlh$LIBP2P_PORT"
+NS_IF="tln$LIBP2P_PORT"
+BASE=$((LIBP2P_PORT * 4))
+NET="10.$((BASE >> 16 & 255)).$((BASE >> 8 & 255))"
+GW_IP="$NET.$(((BASE & 255) + 1))"
+NS_IP="$NET.$(((BASE & 255) + 2))"
+RULES="$NOMAD_TASK_DIR/nat.rules"
+
+ip netns del "$NS" 2>/dev/null || true
+ip link del "$HOST_IF" 2>/dev/null || true
+: > "$RULES"
+
+add_rule() {
+  table=$1
+  chain=$2
+  shift 2
+  iptables -t "$table" -I "$chain" "$@"
+  echo "$table $chain $*" >> "$RULES"
+}
+
+cleanup() {
+  trap - INT TERM
+  rm -f "$READY"
+  while read -r table chain rule; do
+    iptables -t "$table" -D "$chain" $rule 2>/dev/null || true
+  done < "$RULES"
+  ip link del "$HOST_IF" 2>/dev/null || true
+  ip netns del "$NS" 2>/dev/null || true
+  exit 0
+}
+trap cleanup INT TERM
+
+ip netns add "$NS"
+ip link add "$HOST_IF" type veth peer name "$NS_IF"
+ip link set "$NS_IF" netns "$NS"
+ip addr add "$GW_IP/30" dev "$HOST_IF"
+ip link set "$HOST_IF" up
+ip netns exec "$NS" ip link set lo up
+ip netns exec "$NS" ip addr add "$NS_IP/30" dev "$NS_IF"
+ip netns exec "$NS" ip link set "$NS_IF" up
+ip netns exec "$NS" ip route add default via "$GW_IP"
+sysctl -qw net.ipv4.ip_forward=1
+
+# The control and metrics endpoints stay reachable on the host's address.
+for port in $FORWARD_PORTS; do
+  add_rule nat PREROUTING -p tcp -d "$HOST_IP" --dport "$port" -j DNAT --to-destination "$NS_IP:$port"
+  add_rule nat OUTPUT -p tcp -d "$HOST_IP" --dport "$port" -j DNAT --to-destination "$NS_IP:$port"
+  add_rule filter FORWARD -o "$HOST_IF" -p tcp --dport "$port" -j ACCEPT
+done
+add_rule filter FORWARD -i "$HOST_IF" -j ACCEPT
+add_rule filter FORWARD -o "$HOST_IF" -m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT
+
+case "$NAT_TYPE" in
+  full-cone)
+    add_rule nat POSTROUTING -s "$NS_IP" -j SNAT --to-source "$HOST_IP"
+    add_rule nat POSTROUTING -s "$NS_IP" -p tcp --sport "$LIBP2P_PORT" -j SNAT --to-source "$HOST_IP:$LIBP2P_PORT"
+    add_rule nat PREROUTING -p tcp -d "$HOST_IP" --dport "$LIBP2P_PORT" -j DNAT --to-destination "$NS_IP:$LIBP2P_PORT"
+    add_rule nat OUTPUT -p tcp -d "$HOST_IP" --dport "$LIBP2P_PORT" -j DNAT --to-destination "$NS_IP:$LIBP2P_PORT"
+    add_rule filter FORWARD -o "$HOST_IF" -p tcp --dport "$LIBP2P_PORT" -j ACCEPT
+    ;;
+  restricted)
+    add_rule nat POSTROUTING -s "$NS_IP" -j SNAT --to-source "$HOST_IP"
+    add_rule nat POSTROUTING -s "$NS_IP" -p tcp --sport "$LIBP2P_PORT" -j SNAT --to-source "$HOST_IP:$LIBP2P_PORT"
+    ;;
+  symmetric)
+    add_rule nat POSTROUTING -s "$NS_IP" -j MASQUERADE --random
+    ;;
+esac
+
+touch "$READY"
+while :; do
+  sleep 1
+done
+`
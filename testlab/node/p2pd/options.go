@@ -0,0 +1,176 @@
+package p2pd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+// PinnedVersion is the go daemon release whose flags the plugin knows about,
+// the one go.mod pins. It has no flags selecting security transports or
+// setting gossipsub's D and D_lo, so the plugin does not offer them.
+const PinnedVersion = "0.0.4"
+
+// DHT modes supported by the DHT option.
+const (
+	DHTServer = "server"
+	DHTClient = "client"
+	DHTOff    = "off"
+)
+
+// Transports supported by the Transports option, on top of TCP.
+const (
+	QUIC      = "quic"
+	WebSocket = "ws"
+)
+
+// configFlags translates the plugin's typed configuration options into go
+// daemon flags.
+func configFlags(options utils.NodeOptions) ([]string, error) {
+	var args []string
+
+	// Autorelay finds relays through the DHT, and is implied by Relays.
+	autoRelay, _ := options.Bool("AutoRelay")
+	if _, ok := options.String("Relays"); ok {
+		autoRelay = true
+	}
+	mode, ok := options.String("DHT")
+	if !ok {
+		mode = DHTOff
+		if autoRelay {
+			mode = DHTClient
+		}
+	}
+	switch mode {
+	case DHTServer:
+		args = append(args, "-dht")
+	case DHTClient:
+		args = append(args, "-dhtClient")
+	case DHTOff:
+		if autoRelay {
+			return nil, fmt.Errorf("AutoRelay and Relays require the DHT, through which relays are found")
+		}
+	default:
+		return nil, fmt.Errorf("unknown DHT mode %q, expected one of %s, %s or %s", mode, DHTServer, DHTClient, DHTOff)
+	}
+
+	if connMgr, ok := options.Object("ConnManager"); ok {
+		low, lok := connMgr.Int("Low")
+		high, hok := connMgr.Int("High")
+		if !lok || !hok {
+			return nil, fmt.Errorf("ConnManager requires Low and High")
+		}
+		if low < 0 || high < low {
+			return nil, fmt.Errorf("ConnManager requires 0 <= Low <= High, got %d and %d", low, high)
+		}
+		args = append(args, "-connManager", "-connLo", strconv.Itoa(low), "-connHi", strconv.Itoa(high))
+		if grace, ok := connMgr.String("Grace"); ok {
+			if _, err := time.ParseDuration(grace); err != nil {
+				return nil, fmt.Errorf("ConnManager Grace: %s", err)
+			}
+			args = append(args, "-connGrace", grace)
+		}
+	}
+
+	if relay, ok := options.Object("Relay"); ok {
+		if enabled, ok := relay.Bool("Enabled"); ok && !enabled {
+			if autoRelay {
+				return nil, fmt.Errorf("AutoRelay and Relays require Relay to be enabled")
+			}
+			args = append(args, "-relay=false")
+		} else {
+			for _, opt := range []struct{ key, flag string }{
+				{"Hop", "-relayHop"},
+				{"Active", "-relayActive"},
+				{"Discovery", "-relayDiscovery"},
+			} {
+				if set, ok := relay.Bool(opt.key); ok && set {
+					args = append(args, opt.flag)
+				}
+			}
+		}
+	}
+
+	if autoRelay {
+		args = append(args, "-autoRelay")
+	}
+
+	if autonat, ok := options.Bool("AutoNAT"); ok && autonat {
+		args = append(args, "-autonat")
+	}
+
+	if gossipsub, ok := options.Object("Gossipsub"); ok {
+		for _, opt := range []struct{ key, flag string }{
+			{"HeartbeatInterval", "-gossipsubHeartbeatInterval"},
+			{"HeartbeatInitialDelay", "-gossipsubHeartbeatInitialDelay"},
+		} {
+			if d, ok := gossipsub.String(opt.key); ok {
+				if _, err := time.ParseDuration(d); err != nil {
+					return nil, fmt.Errorf("Gossipsub %s: %s", opt.key, err)
+				}
+				args = append(args, opt.flag, d)
+			}
+		}
+		if sign, ok := gossipsub.Bool("Sign"); ok {
+			args = append(args, fmt.Sprintf("-pubsubSign=%t", sign))
+		}
+		if strict, ok := gossipsub.Bool("StrictVerification"); ok {
+			args = append(args, fmt.Sprintf("-pubsubSignStrict=%t", strict))
+		}
+	}
+
+	return args, nil
+}
+
+// transports returns the flags, host addresses and ports needed for the
+// transports enabled by the Transports option, at the given IP and the ports
+// held by the environment variables with the given prefix, e.g. NOMAD_PORT.
+func transports(options utils.NodeOptions, ip, portVar string) ([]string, []string, []napi.Port, error) {
+	names, ok := options.StringSlice("Transports")
+	if !ok {
+		return nil, nil, nil, nil
+	}
+	var (
+		args  []string
+		addrs []string
+		ports []napi.Port
+	)
+	for _, name := range names {
+		switch name {
+		case "tcp":
+		case QUIC:
+			// Dynamic ports are reserved for both TCP and UDP, so QUIC can share
+			// the libp2p port.
+			args = append(args, "-quic")
+			addrs = append(addrs, fmt.Sprintf("/ip4/%s/udp/${%s_libp2p}/quic", ip, portVar))
+		case WebSocket:
+			addrs = append(addrs, fmt.Sprintf("/ip4/%s/tcp/${%s_ws}/ws", ip, portVar))
+			ports = append(ports, napi.Port{Label: "ws"})
+		default:
+			return nil, nil, nil, fmt.Errorf("unknown transport %q, expected tcp, %s or %s", name, QUIC, WebSocket)
+		}
+	}
+	return args, addrs, ports, nil
+}
+
+// validateVersion checks that the go daemon is of a release whose flags the
+// plugin knows. Only PinnedVersion's are, so daemons of other releases are
+// rejected rather than handed flags they may not have.
+func validateVersion(version string) error {
+	if strings.TrimPrefix(version, "v") != PinnedVersion {
+		return fmt.Errorf("unknown p2pd version %q, only %s is supported", version, PinnedVersion)
+	}
+	return nil
+}
+
+// flagName strips the value from flags of the form -name=value.
+func flagName(arg string) string {
+	if i := strings.Index(arg, "="); i >= 0 {
+		return arg[:i]
+	}
+	return arg
+}
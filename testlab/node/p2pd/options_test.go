@@ -0,0 +1,111 @@
+package p2pd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/testlab/utils"
+)
+
+// parseOptions decodes plugin options as topologies do.
+func parseOptions(t *testing.T, raw string) utils.NodeOptions {
+	var options utils.NodeOptions
+	if err := json.Unmarshal([]byte(raw), &options); err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func TestConfigFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  string
+		expected []string
+		fails    bool
+	}{
+		{name: "none", options: `{}`},
+		{name: "dht server", options: `{"DHT": "server"}`, expected: []string{"-dht"}},
+		{name: "dht client", options: `{"DHT": "client"}`, expected: []string{"-dhtClient"}},
+		{name: "dht off", options: `{"DHT": "off"}`},
+		{name: "unknown dht mode", options: `{"DHT": "full"}`, fails: true},
+		{
+			name:     "conn manager",
+			options:  `{"ConnManager": {"Low": 10, "High": 20, "Grace": "30s"}}`,
+			expected: []string{"-connManager", "-connLo", "10", "-connHi", "20", "-connGrace", "30s"},
+		},
+		{name: "conn manager without high", options: `{"ConnManager": {"Low": 10}}`, fails: true},
+		{name: "conn manager inverted", options: `{"ConnManager": {"Low": 20, "High": 10}}`, fails: true},
+		{name: "conn manager bad grace", options: `{"ConnManager": {"Low": 1, "High": 2, "Grace": "soon"}}`, fails: true},
+		{
+			name:     "relay",
+			options:  `{"Relay": {"Hop": true, "Active": false, "Discovery": true}}`,
+			expected: []string{"-relayHop", "-relayDiscovery"},
+		},
+		{name: "relay disabled", options: `{"Relay": {"Enabled": false, "Hop": true}}`, expected: []string{"-relay=false"}},
+		{name: "autonat", options: `{"AutoNAT": true}`, expected: []string{"-autonat"}},
+		{name: "autorelay", options: `{"AutoRelay": true}`, expected: []string{"-dhtClient", "-autoRelay"}},
+		{name: "autorelay dht server", options: `{"AutoRelay": true, "DHT": "server"}`, expected: []string{"-dht", "-autoRelay"}},
+		{name: "autorelay dht off", options: `{"AutoRelay": true, "DHT": "off"}`, fails: true},
+		{name: "autorelay relay disabled", options: `{"AutoRelay": true, "Relay": {"Enabled": false}}`, fails: true},
+		{name: "relays imply autorelay", options: `{"Relays": "relays"}`, expected: []string{"-dhtClient", "-autoRelay"}},
+		{
+			name:    "gossipsub",
+			options: `{"Gossipsub": {"HeartbeatInterval": "1s", "HeartbeatInitialDelay": "100ms", "Sign": true, "StrictVerification": false}}`,
+			expected: []string{
+				"-gossipsubHeartbeatInterval", "1s",
+				"-gossipsubHeartbeatInitialDelay", "100ms",
+				"-pubsubSign=true",
+				"-pubsubSignStrict=false",
+			},
+		},
+		{name: "gossipsub bad interval", options: `{"Gossipsub": {"HeartbeatInterval": "often"}}`, fails: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args, err := configFlags(parseOptions(t, tc.options))
+			if tc.fails {
+				if err == nil {
+					t.Fatalf("expected an error, got flags %v", args)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(args, tc.expected) {
+				t.Fatalf("expected flags %v, got %v", tc.expected, args)
+			}
+			// Every flag must be known, so that it can be translated.
+			for _, arg := range args {
+				if arg[0] != '-' {
+					continue
+				}
+				if _, ok := goFlags[flagName(arg)]; !ok {
+					t.Fatalf("unknown flag %s", arg)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		version string
+		fails   bool
+	}{
+		{PinnedVersion, false},
+		{"v" + PinnedVersion, false},
+		{"0.0.3", true},
+		{"0.2.0", true},
+		{"latest", true},
+	} {
+		t.Run(tc.version, func(t *testing.T) {
+			err := validateVersion(tc.version)
+			if tc.fails && err == nil {
+				t.Fatalf("version %s accepted", tc.version)
+			} else if !tc.fails && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
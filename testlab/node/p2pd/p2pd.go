@@ -1,15 +1,14 @@
 package p2pd
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
-
-	"io/ioutil"
-	"os"
+	"strings"
 
 	capi "github.com/hashicorp/consul/api"
 	napi "github.com/hashicorp/nomad/api"
 	"github.com/libp2p/go-libp2p-daemon/p2pclient"
+	"github.com/libp2p/testlab/artifact"
 	"github.com/libp2p/testlab/utils"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/sirupsen/logrus"
@@ -17,12 +16,79 @@ import (
 
 type Node struct{}
 
-func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
+// RelayServiceName is the name of the consul service exposing the libp2p
+// endpoint of each relay deployed by the relay plugin.
+const RelayServiceName = "relay"
+
+// peerSource is a consul service whose instances with the given tag are peers
+// to connect to.
+type peerSource struct {
+	tag     string
+	service string
+}
+
+// peersTemplate renders the multiaddrs of the instances of the given sources,
+// separated by commas, along with the peer IDs recorded under the given KV
+// prefix, into the given environment variable.
+func peersTemplate(envVar, peerIDs string, sources ...peerSource) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `%s={{scratch.Set "sep" ""}}`, envVar)
+	for _, src := range sources {
+		fmt.Fprintf(&b, `{{range service "%s.%s"}}{{scratch.Get "sep"}}/ip4/{{.Address}}/tcp/{{.Port}}/p2p/{{printf "%s/ip4/%%s/tcp/%%d" .Address .Port | key}}{{scratch.Set "sep" ","}}{{end}}`, src.tag, src.service, peerIDs)
+	}
+	return b.String()
+}
+
+// Task creates the daemon's task. Daemons behind a NAT need a second task, so
+// the NAT option is only supported through Tasks.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	if _, ok := options.String("NAT"); ok {
+		return nil, fmt.Errorf("the NAT option requires the daemon's tasks to be generated with Tasks")
+	}
+	tasks, err := n.Tasks(deployment, options)
+	if err != nil {
+		return nil, err
+	}
+	return tasks[0], nil
+}
+
+// Tasks creates the daemon's task, followed by the task setting up its NAT if
+// the NAT option is set.
+func (n *Node) Tasks(deployment *utils.DeploymentContext, options utils.NodeOptions) ([]*napi.Task, error) {
 	task := napi.NewTask("p2pd", "exec")
-	command := "/usr/local/bin/p2pd"
+	implName := Go
+	if name, ok := options.String("Implementation"); ok {
+		implName = name
+	}
+	impl, err := lookupImplementation(implName)
+	if err != nil {
+		return nil, err
+	}
+	if version, ok := options.String("Version"); ok && implName == Go {
+		if err := validateVersion(version); err != nil {
+			return nil, err
+		}
+	}
+	natType, nat := options.String("NAT")
+	image, docker := options.String("Image")
+	if nat && docker {
+		return nil, fmt.Errorf("the NAT option is not supported with Image")
+	}
+	hostNetwork, _ := options.Bool("HostNetwork")
+	// In a container with its own network, the daemon listens on the container
+	// ports the dynamic ports are mapped to.
+	mapped := docker && !hostNetwork
+	// Behind a NAT, or in a container, the daemon listens on every interface
+	// of its own network namespace rather than on the host's address.
+	listenIP := "${NOMAD_IP_p2pd}"
+	metricsAddr := "${NOMAD_ADDR_metrics}"
+	if nat || mapped {
+		listenIP = "0.0.0.0"
+		metricsAddr = "0.0.0.0:${NOMAD_PORT_metrics}"
+	}
 	args := []string{
-		"-listen", "/ip4/${NOMAD_IP_p2pd}/tcp/${NOMAD_PORT_p2pd}",
-		"-metricsAddr", "${NOMAD_ADDR_metrics}",
+		"-listen", fmt.Sprintf("/ip4/%s/tcp/${NOMAD_PORT_p2pd}", listenIP),
+		"-metricsAddr", metricsAddr,
 		"-pubsub",
 	}
 
@@ -30,14 +96,30 @@ func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		args = append(args, "-pubsubRouter", router)
 	}
 
+	config, err := configFlags(options)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, config...)
+
+	libp2pIP := "${NOMAD_IP_libp2p}"
+	if mapped {
+		libp2pIP = "0.0.0.0"
+	}
+	transportArgs, transportAddrs, transportPorts, err := transports(options, libp2pIP, "NOMAD_PORT")
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, transportArgs...)
+
 	res := napi.DefaultResources()
 	res.Networks = []*napi.NetworkResource{
 		&napi.NetworkResource{
-			DynamicPorts: []napi.Port{
+			DynamicPorts: append([]napi.Port{
 				napi.Port{Label: "libp2p"},
 				napi.Port{Label: "p2pd"},
 				napi.Port{Label: "metrics"},
-			},
+			}, transportPorts...),
 		},
 	}
 	task.Require(res)
@@ -52,10 +134,40 @@ func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		PortLabel:   "p2pd",
 		AddressMode: "host",
 	}
-	task.Services = append(task.Services, metricsSvc, p2pdSvc)
+	// Implementations without a metrics endpoint would never pass scraping.
+	if impl.supports("-metricsAddr") {
+		task.Services = append(task.Services, metricsSvc)
+	}
+	task.Services = append(task.Services, p2pdSvc)
+
+	undialable, _ := options.Bool("Undialable")
+	if nat && len(transportAddrs) > 0 {
+		return nil, fmt.Errorf("only the tcp transport is supported behind a NAT")
+	}
+	if !nat && !undialable && len(transportAddrs) > 0 {
+		return nil, fmt.Errorf("Transports require the Undialable option, without which the daemon does not listen")
+	}
 
-	if noBind, ok := options.Bool("Undialable"); ok && noBind {
-		args = append(args, "-hostAddrs", "/ip4/${NOMAD_IP_libp2p}/tcp/${NOMAD_PORT_libp2p}")
+	if nat {
+		args = append(args, "-hostAddrs", "/ip4/0.0.0.0/tcp/${NOMAD_PORT_libp2p}")
+		libp2pSvc := &napi.Service{
+			Name:        "libp2p",
+			PortLabel:   "libp2p",
+			AddressMode: "host",
+		}
+		task.Services = append(task.Services, libp2pSvc)
+	} else if undialable {
+		hostAddrs := append([]string{fmt.Sprintf("/ip4/%s/tcp/${NOMAD_PORT_libp2p}", libp2pIP)}, transportAddrs...)
+		args = append(args, "-hostAddrs", strings.Join(hostAddrs, ","))
+		if mapped {
+			// Peers reach the daemon through the host's ports.
+			_, announceAddrs, _, err := transports(options, "${NOMAD_IP_libp2p}", "NOMAD_HOST_PORT")
+			if err != nil {
+				return nil, err
+			}
+			announceAddrs = append([]string{"/ip4/${NOMAD_IP_libp2p}/tcp/${NOMAD_HOST_PORT_libp2p}"}, announceAddrs...)
+			args = append(args, "-announceAddrs", strings.Join(announceAddrs, ","))
+		}
 		libp2pSvc := &napi.Service{
 			Name:        "libp2p",
 			PortLabel:   "libp2p",
@@ -66,24 +178,28 @@ func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		args = append(args, "-noListenAddrs")
 	}
 
-	url := ""
-
-	if cid, ok := options.String("Cid"); ok {
-		url = fmt.Sprintf("https://gateway.ipfs.io/ipfs/%s", cid)
+	if checks, ok := options.Bool("Checks"); !ok || checks {
+		if err := addChecks(task, nat, options); err != nil {
+			return nil, err
+		}
 	}
 
-	if urlOpt, ok := options.String("Fetch"); ok {
-		url = urlOpt
+	fetched, err := artifact.Resolve(deployment, options, "p2pd")
+	if err != nil {
+		return nil, err
 	}
-
-	if url != "" {
-		task.Artifacts = []*napi.TaskArtifact{
-			&napi.TaskArtifact{
-				GetterSource: utils.StringPtr(url),
-				RelativeDest: utils.StringPtr("p2pd"),
-			},
+	var (
+		command    string
+		prefixArgs []string
+	)
+	if docker {
+		if fetched != nil {
+			return nil, fmt.Errorf("the Image option cannot be combined with fetched artifacts")
 		}
-		command = "p2pd"
+		// The image's entrypoint runs the daemon, unless overridden.
+		command, _ = options.String("Entrypoint")
+	} else if command, prefixArgs, err = impl.provision(task, fetched, options); err != nil {
+		return nil, err
 	}
 
 	if tags, ok := options.StringSlice("Tags"); ok {
@@ -92,9 +208,36 @@ func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		}
 	}
 
+	if name, ok := options.String("VersionName"); ok {
+		for _, service := range task.Services {
+			service.Tags = append(append([]string{}, service.Tags...), VersionTag(name))
+		}
+	}
+
+	// With fixed identities, PostDeploy records peer IDs by the address of
+	// each instance's libp2p service rather than by asking the daemons.
+	if _, ok := options.Object("Identity"); ok {
+		for _, service := range task.Services {
+			if service.Name == "libp2p" {
+				service.Tags = append(append([]string{}, service.Tags...), InstanceTag(deployment))
+			}
+		}
+	}
+
+	var peerSources []peerSource
 	if bootstrap, ok := options.String("Bootstrap"); ok {
-		tmpl := `BOOTSTRAP_PEERS={{range $index, $service := service "%s.libp2p"}}{{if ne $index 0}},{{end}}/ip4/{{$service.Address}}/tcp/{{$service.Port}}/p2p/{{printf "/peerids/ip4/%%s/tcp/%%d" $service.Address $service.Port | key}}{{end}}`
-		tmpl = fmt.Sprintf(tmpl, bootstrap)
+		peerSources = append(peerSources, peerSource{bootstrap, deployment.ServiceName("libp2p")})
+	}
+	if relays, ok := options.String("Relays"); ok {
+		// The daemon dials the relays as it starts, and autorelay, enabled by
+		// configFlags, finds them through the DHT.
+		if !impl.supports("-autoRelay") {
+			return nil, fmt.Errorf("Relays is not supported by the %s daemon", implName)
+		}
+		peerSources = append(peerSources, peerSource{utils.DeploymentTag(deployment.RunID, relays), deployment.ServiceName(RelayServiceName)})
+	}
+	if len(peerSources) > 0 {
+		tmpl := peersTemplate("BOOTSTRAP_PEERS", deployment.Key("peerids"), peerSources...)
 		env := true
 		template := &napi.Template{
 			EmbeddedTmpl: &tmpl,
@@ -105,61 +248,140 @@ func (n *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		args = append(args, "-b", "-bootstrapPeers", "${BOOTSTRAP_PEERS}")
 	}
 
+	identityArgs, err := addIdentity(task, deployment, options)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, identityArgs...)
+
+	args = append(prefixArgs, impl.translate(args)...)
+
+	if nat {
+		return natTasks(task, natType, command, args)
+	}
+	if docker {
+		utils.UseDocker(task, image, command, args, hostNetwork)
+		return []*napi.Task{task}, nil
+	}
+
 	task.SetConfig("command", command)
 	task.SetConfig("args", args)
 
-	return task, nil
+	return []*napi.Task{task}, nil
 }
 
-func (n *Node) PostDeploy(consul *capi.Client, options utils.NodeOptions) error {
+// PostDeploy records the peer ID of every daemon in the deployment in consul's
+// KV store. Daemons are identified concurrently, retrying those that are not
+// yet listening, and every daemon is attempted even if some fail. Peer IDs
+// fixed by the Identity option are recorded without contacting the daemons,
+// under the address of each daemon's libp2p service.
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	ids, err := PeerIDs(deployment, options)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		kv := &capi.KVPair{
+			Key:   identityKey(deployment, i),
+			Value: []byte(id.Pretty()),
+		}
+		if _, err := consul.KV().Put(kv, nil); err != nil {
+			return err
+		}
+	}
+	if !recordsPeerIDs(options) {
+		// Daemons without a libp2p service do not listen, so no peer can
+		// look them up by address.
+		if ids == nil || !listens(options) {
+			return nil
+		}
+		return RecordIdentities(ctx, consul, deployment, "libp2p", ids)
+	}
+
 	tags, ok := options.StringSlice("Tags")
 	if !ok {
 		logrus.Info("skipping post deploy for p2pd, no Tags option")
 		return nil
 	}
+	return forEachDaemon(ctx, consul, deployment, tags, options, func(consul *capi.Client, controlAddr string) error {
+		return recordPeerID(consul, deployment, controlAddr)
+	})
+}
 
-	svcs, _, err := consul.Catalog().ServiceMultipleTags("p2pd", tags, nil)
+// PreDestroy removes the peer IDs fixed by the Identity option from consul's
+// KV store. Records keyed by address are shared with the run's other
+// deployments, and left for testlab stop to remove with the rest of the run.
+func (n *Node) PreDestroy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	_, err := consul.KV().DeleteTree(deployment.Key("identities", deployment.Deployment)+"/", nil)
+	return err
+}
+
+const defaultPostDeployParallelism = 16
+
+// forEachDaemon calls fn concurrently with the control address of every
+// daemon of the deployment's run registered with the given tags, retrying
+// failed calls.
+func forEachDaemon(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, tags []string, options utils.NodeOptions, fn func(*capi.Client, string) error) error {
+	svcs, _, err := consul.Catalog().ServiceMultipleTags(deployment.ServiceName("p2pd"), tags, nil)
 	if err != nil {
 		return err
 	}
-	bootstrapControlAddrs := make([]ma.Multiaddr, len(svcs))
+	controlAddrs := make([]string, len(svcs))
 	for i, svc := range svcs {
-		addrStr := fmt.Sprintf("/ip4/%s/tcp/%d", svc.ServiceAddress, svc.ServicePort)
-		addr, err := ma.NewMultiaddr(addrStr)
-		if err != nil {
-			return err
-		}
-		bootstrapControlAddrs[i] = addr
+		controlAddrs[i] = fmt.Sprintf("/ip4/%s/tcp/%d", svc.ServiceAddress, svc.ServicePort)
 	}
-	for _, addr := range bootstrapControlAddrs {
-		dir, err := ioutil.TempDir(os.TempDir(), "daemon_client")
+
+	parallelism := defaultPostDeployParallelism
+	if p, ok := options.Int("PostDeployParallelism"); ok {
+		parallelism = p
+	}
+	backoff := utils.DefaultBackoff
+	if attempts, ok := options.Int("PostDeployAttempts"); ok {
+		backoff.Attempts = attempts
+	}
+
+	return utils.ForEach(ctx, parallelism, controlAddrs, func(ctx context.Context, controlAddr string) error {
+		return utils.Retry(ctx, backoff, func() error {
+			return fn(consul, controlAddr)
+		})
+	})
+}
+
+// identify asks the daemon listening on the given control address for its
+// peer ID and listen addresses.
+func identify(controlAddr string) (string, []ma.Multiaddr, error) {
+	var (
+		peerID string
+		addrs  []ma.Multiaddr
+	)
+	err := utils.WithDaemonClient(controlAddr, func(client *p2pclient.Client) error {
+		id, as, err := client.Identify()
 		if err != nil {
 			return err
 		}
-		sockPath := filepath.Join("/unix", dir, "ignore.sock")
-		listenAddr, _ := ma.NewMultiaddr(sockPath)
-		client, err := p2pclient.NewClient(addr, listenAddr)
-		if err != nil {
-			return err
+		peerID, addrs = id.Pretty(), as
+		return nil
+	})
+	return peerID, addrs, err
+}
+
+// recordPeerID identifies the daemon listening on the given control address,
+// storing its peer ID under each of its listen addresses in the run's KV
+// namespace.
+func recordPeerID(consul *capi.Client, deployment *utils.DeploymentContext, controlAddr string) error {
+	peerID, addrs, err := identify(controlAddr)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		kv := &capi.KVPair{
+			Key:   deployment.Key("peerids", addr.String()),
+			Value: []byte(peerID),
 		}
-		defer func() {
-			client.Close()
-			os.RemoveAll(dir)
-		}()
-		peerID, addrs, err := client.Identify()
+		_, err = consul.KV().Put(kv, nil)
 		if err != nil {
 			return err
 		}
-		for _, addr := range addrs {
-			kv := &capi.KVPair{
-				Key:   fmt.Sprintf("peerids%s", addr.String()),
-				Value: []byte(peerID.Pretty()),
-			}
-			_, err = consul.KV().Put(kv, nil)
-			if err != nil {
-				return err
-			}
-		}
 	}
 	return nil
 }
@@ -0,0 +1,60 @@
+package p2pd
+
+import (
+	"fmt"
+
+	"github.com/libp2p/testlab/testlab/node"
+	"github.com/libp2p/testlab/utils"
+)
+
+// VersionTag is the tag applied to the services of daemons of the named
+// version.
+func VersionTag(name string) string {
+	return fmt.Sprintf("version-%s", name)
+}
+
+// Variants splits the deployment into the weighted versions listed by the
+// Versions option. Each version's options are the deployment's, overridden by
+// those given alongside the version's Name and Weight.
+func (n *Node) Variants(options utils.NodeOptions) ([]*node.Variant, error) {
+	versions, ok := options.Slice("Versions")
+	if !ok {
+		return nil, nil
+	}
+	variants := make([]*node.Variant, len(versions))
+	names := make(map[string]struct{}, len(versions))
+	for i, v := range versions {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Versions must be a list of objects")
+		}
+		version := utils.NodeOptions(obj)
+		name, _ := version.String("Name")
+		if !utils.ValidTaskNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("version names must be alpha-numeric, got %q", name)
+		}
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("version %s is listed more than once", name)
+		}
+		names[name] = struct{}{}
+		weight := 1.0
+		if w, ok := version.Float("Weight"); ok {
+			weight = w
+		}
+
+		variantOptions := make(utils.NodeOptions, len(options)+len(version))
+		for key, value := range options {
+			if key != "Versions" {
+				variantOptions[key] = value
+			}
+		}
+		for key, value := range version {
+			if key != "Name" && key != "Weight" {
+				variantOptions[key] = value
+			}
+		}
+		variantOptions["VersionName"] = name
+		variants[i] = &node.Variant{Name: name, Weight: weight, Options: variantOptions}
+	}
+	return variants, nil
+}
@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"context"
+	"fmt"
 	"time"
 
 	capi "github.com/hashicorp/consul/api"
@@ -22,17 +24,23 @@ scrape_configs:
     consul_sd_configs:
     - server: '{{ env "CONSUL_HTTP_ADDR" }}'
       datacenter: '{{ or (env "CONSUL_DATACENTER") "" }}'
-      services: ['metrics']
+      services: ['%s']
+
+    # Segment metrics by the version of the daemon exposing them.
+    relabel_configs:
+    - source_labels: [__meta_consul_tags]
+      regex: '.*,version-([^,]+),.*'
+      target_label: version
 
     scrape_interval: 5s
 `
 
-func (n *Node) PostDeploy(consul *capi.Client, options utils.NodeOptions) error {
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
 	return nil
 }
 
 // Task creates a nomad task specification for our prometheus metrics collector
-func (n *Node) Task(opts utils.NodeOptions) (*napi.Task, error) {
+func (n *Node) Task(deployment *utils.DeploymentContext, opts utils.NodeOptions) (*napi.Task, error) {
 	task := napi.NewTask("prometheus", "docker")
 
 	res := napi.DefaultResources()
@@ -53,9 +61,11 @@ func (n *Node) Task(opts utils.NodeOptions) (*napi.Task, error) {
 	task.Resources = res
 
 	task.Env = make(map[string]string)
-	utils.AddConsulEnvToTask(task)
+	utils.AddClusterEnvToTask(task, deployment)
+	// Only scrape the metrics services of this run.
+	cfg := fmt.Sprintf(config, deployment.ServiceName("metrics"))
 	tpl := &napi.Template{
-		EmbeddedTmpl: &config,
+		EmbeddedTmpl: &cfg,
 		DestPath:     utils.StringPtr("local/prometheus.yml"),
 	}
 	task.Templates = append(task.Templates, tpl)
@@ -0,0 +1,160 @@
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/libp2p/testlab/testlab/node/external"
+	"github.com/libp2p/testlab/utils"
+)
+
+// Factory creates a new instance of a plugin.
+type Factory func() Node
+
+// Registry maps plugin names to the factories creating them. It is safe for
+// concurrent use.
+type Registry struct {
+	lk        sync.RWMutex
+	factories map[string]Factory
+}
+
+// DefaultRegistry is the registry used by testlabs created without a custom
+// one. The built in plugins are registered in it by the builtin package.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]Factory),
+	}
+}
+
+// Register adds a plugin to the registry, failing if the name is taken.
+func (r *Registry) Register(name string, factory Factory) error {
+	if name == "" || strings.ContainsRune(name, '/') {
+		return fmt.Errorf("invalid plugin name \"%s\"", name)
+	}
+	if factory == nil {
+		return fmt.Errorf("plugin \"%s\" has no factory", name)
+	}
+
+	r.lk.Lock()
+	defer r.lk.Unlock()
+	if _, ok := r.factories[name]; ok {
+		return fmt.Errorf("plugin \"%s\" already registered", name)
+	}
+	r.factories[name] = factory
+	return nil
+}
+
+// New creates an instance of a registered plugin.
+func (r *Registry) New(name string) (Node, error) {
+	r.lk.RLock()
+	factory, ok := r.factories[name]
+	r.lk.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("plugin \"%s\" not registered", name)
+	}
+	return factory(), nil
+}
+
+// Names returns the names of all registered plugins, sorted.
+func (r *Registry) Names() []string {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Registry) has(name string) bool {
+	r.lk.RLock()
+	defer r.lk.RUnlock()
+	_, ok := r.factories[name]
+	return ok
+}
+
+// Resolve creates an instance of the named plugin. Names containing a slash
+// are treated as paths to external plugin executables, otherwise registered
+// plugins take precedence over external plugins found in the directories of
+// pluginPath.
+func (r *Registry) Resolve(name string, pluginPath []string) (Node, error) {
+	if strings.ContainsRune(name, '/') {
+		return newExternal(name)
+	}
+	if r.has(name) {
+		return r.New(name)
+	}
+	if path, ok := external.Find(name, pluginPath); ok {
+		return newExternal(path)
+	}
+	return nil, fmt.Errorf("plugin \"%s\" not registered", name)
+}
+
+// externalNode adapts an external plugin to the Splitter interface, whose
+// Variant type the external package cannot refer to.
+type externalNode struct {
+	*external.Node
+}
+
+func newExternal(path string) (Node, error) {
+	ext, err := external.New(path)
+	if err != nil {
+		return nil, err
+	}
+	return &externalNode{ext}, nil
+}
+
+func (n *externalNode) Variants(options utils.NodeOptions) ([]*Variant, error) {
+	variants, err := n.Node.Variants(options)
+	if err != nil {
+		return nil, err
+	}
+	converted := make([]*Variant, len(variants))
+	for i, v := range variants {
+		converted[i] = &Variant{Name: v.Name, Weight: v.Weight, Options: v.Options}
+	}
+	return converted, nil
+}
+
+// PluginInfo describes a plugin available to topologies.
+type PluginInfo struct {
+	Name string
+	// Path is the path to the plugin's executable, empty for registered
+	// plugins.
+	Path string
+}
+
+// List lists the registered plugins, followed by the external plugins found in
+// the directories of pluginPath, each sorted by name.
+func (r *Registry) List(pluginPath []string) ([]*PluginInfo, error) {
+	var plugins []*PluginInfo
+	for _, name := range r.Names() {
+		plugins = append(plugins, &PluginInfo{Name: name})
+	}
+
+	discovered, err := external.Discover(pluginPath)
+	if err != nil {
+		return nil, err
+	}
+	var externals []*PluginInfo
+	for name, path := range discovered {
+		if r.has(name) {
+			continue
+		}
+		externals = append(externals, &PluginInfo{Name: name, Path: path})
+	}
+	sort.Slice(externals, func(i, j int) bool { return externals[i].Name < externals[j].Name })
+
+	return append(plugins, externals...), nil
+}
+
+// Register adds a plugin to the default registry.
+func Register(name string, factory Factory) error {
+	return DefaultRegistry.Register(name, factory)
+}
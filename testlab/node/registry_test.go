@@ -0,0 +1,72 @@
+package node
+
+import (
+	"context"
+	"testing"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/utils"
+)
+
+type testNode struct{}
+
+func (n *testNode) Task(*utils.DeploymentContext, utils.NodeOptions) (*napi.Task, error) {
+	return napi.NewTask("test", "exec"), nil
+}
+
+func (n *testNode) PostDeploy(context.Context, *capi.Client, *utils.DeploymentContext, utils.NodeOptions) error {
+	return nil
+}
+
+func newTestNode() Node {
+	return new(testNode)
+}
+
+func TestRegistryRegister(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		plugins []string
+		factory Factory
+		// The name registered last, and whether registering it fails.
+		register string
+		fails    bool
+	}{
+		{"first", nil, newTestNode, "p2pd", false},
+		{"distinct", []string{"p2pd"}, newTestNode, "ipfs", false},
+		{"duplicate", []string{"p2pd"}, newTestNode, "p2pd", true},
+		{"duplicate among several", []string{"ipfs", "p2pd", "relay"}, newTestNode, "relay", true},
+		{"empty name", nil, newTestNode, "", true},
+		{"path", nil, newTestNode, "./bin/plugin", true},
+		{"no factory", nil, nil, "p2pd", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := NewRegistry()
+			for _, name := range tc.plugins {
+				if err := r.Register(name, newTestNode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := r.Register(tc.register, tc.factory)
+			if tc.fails && err == nil {
+				t.Fatalf("registering %q succeeded, expected an error", tc.register)
+			} else if !tc.fails && err != nil {
+				t.Fatalf("registering %q: %s", tc.register, err)
+			}
+
+			// A failed registration leaves the registry untouched.
+			expected := len(tc.plugins)
+			if !tc.fails {
+				expected++
+			}
+			if names := r.Names(); len(names) != expected {
+				t.Fatalf("expected %d plugins, got %v", expected, names)
+			}
+			if !tc.fails {
+				if _, err := r.New(tc.register); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
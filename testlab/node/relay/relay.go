@@ -0,0 +1,104 @@
+// Package relay implements a plugin deploying circuit relays: go daemons
+// acting as relay hops, which p2pd daemons can use through their Relays
+// option.
+package relay
+
+import (
+	"context"
+	"fmt"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/testlab/node/p2pd"
+	"github.com/libp2p/testlab/utils"
+)
+
+// DefaultTag is the tag applied to the services of relays without a Tags
+// option, so that their peer IDs are recorded.
+const DefaultTag = "relay"
+
+// Node builds relay tasks. It accepts the options of the p2pd plugin, and
+// shares its hooks.
+type Node struct {
+	p2pd.Node
+}
+
+// Task creates a nomad task specification for a go daemon listening on its
+// libp2p port and acting as a relay hop, exposed as the relay service.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	if _, ok := options.String("NAT"); ok {
+		return nil, fmt.Errorf("relays cannot be placed behind a NAT")
+	}
+	if impl, ok := options.String("Implementation"); ok && impl != p2pd.Go {
+		return nil, fmt.Errorf("relays must use the %s implementation", p2pd.Go)
+	}
+	task, err := n.Node.Task(deployment, relayOptions(options))
+	if err != nil {
+		return nil, err
+	}
+	for _, svc := range task.Services {
+		if svc.Name != "libp2p" {
+			continue
+		}
+		task.Services = append(task.Services, &napi.Service{
+			Name:        p2pd.RelayServiceName,
+			PortLabel:   svc.PortLabel,
+			AddressMode: svc.AddressMode,
+			Tags:        svc.Tags,
+			Checks:      svc.Checks,
+		})
+		break
+	}
+	return task, nil
+}
+
+// Tasks creates the relay's task, overriding the p2pd plugin's Tasks so that
+// relays are always generated by Task.
+func (n *Node) Tasks(deployment *utils.DeploymentContext, options utils.NodeOptions) ([]*napi.Task, error) {
+	task, err := n.Task(deployment, options)
+	if err != nil {
+		return nil, err
+	}
+	return []*napi.Task{task}, nil
+}
+
+// PostDeploy records the peer ID of every relay, as the p2pd plugin does,
+// defaulting the relays' options like Task.
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return n.Node.PostDeploy(ctx, consul, deployment, relayOptions(options))
+}
+
+// PreDestroy forgets the peer IDs fixed by the Identity option, as the p2pd
+// plugin does.
+func (n *Node) PreDestroy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	return n.Node.PreDestroy(ctx, consul, deployment, relayOptions(options))
+}
+
+// relayOptions returns the p2pd options of a relay: the given options, with
+// the daemon listening, relaying as a hop advertised in the DHT, and
+// recording its peer ID, so that daemons can template its address.
+func relayOptions(options utils.NodeOptions) utils.NodeOptions {
+	opts := make(utils.NodeOptions, len(options)+6)
+	for key, value := range options {
+		opts[key] = value
+	}
+	relay := utils.NodeOptions{}
+	if r, ok := options.Object("Relay"); ok {
+		for key, value := range r {
+			relay[key] = value
+		}
+	}
+	relay["Enabled"] = true
+	relay["Hop"] = true
+	opts["Relay"] = relay
+	// Hops with autorelay advertise themselves in the DHT, where autorelay
+	// clients look for relays.
+	opts["AutoRelay"] = true
+	opts["DHT"] = p2pd.DHTServer
+	opts["Undialable"] = true
+	opts["RecordPeerIDs"] = true
+	if _, ok := opts.StringSlice("Tags"); !ok {
+		opts["Tags"] = []interface{}{DefaultTag}
+	}
+	return opts
+}
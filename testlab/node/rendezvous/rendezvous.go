@@ -0,0 +1,123 @@
+// Package rendezvous implements a plugin deploying libp2p rendezvous servers,
+// whose addresses and peer IDs are published in consul for daemons and
+// scenarios to discover each other through.
+package rendezvous
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
+	"github.com/libp2p/testlab/testlab/node/p2pd"
+	"github.com/libp2p/testlab/utils"
+)
+
+// ServiceName is the name of the consul service exposing the libp2p endpoint
+// of each rendezvous server.
+const ServiceName = "rendezvous"
+
+// Node builds rendezvous server tasks.
+type Node struct{}
+
+// Task creates a nomad task specification for a rendezvous server listening on
+// its libp2p port, with the fixed identity configured by its Identity option.
+func (n *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
+	task := napi.NewTask("rendezvous", "exec")
+
+	res := napi.DefaultResources()
+	res.Networks = []*napi.NetworkResource{
+		&napi.NetworkResource{
+			DynamicPorts: []napi.Port{
+				napi.Port{Label: "libp2p"},
+			},
+		},
+	}
+	if mem, ok := options.Int("Memory"); ok {
+		res.MemoryMB = &mem
+	}
+	task.Require(res)
+
+	keyPath, err := p2pd.IdentityFile(task, deployment, options)
+	if err != nil {
+		return nil, err
+	}
+	if keyPath == "" {
+		return nil, fmt.Errorf("rendezvous servers require the Identity option, so that their peer IDs are known")
+	}
+
+	tags := []string{p2pd.InstanceTag(deployment)}
+	if extra, ok := options.StringSlice("Tags"); ok {
+		tags = append(tags, extra...)
+	}
+	task.Services = append(task.Services, &napi.Service{
+		Name:        ServiceName,
+		PortLabel:   "libp2p",
+		AddressMode: "host",
+		Tags:        tags,
+		Checks: []napi.ServiceCheck{
+			napi.ServiceCheck{
+				Name:     "rendezvous port alive",
+				Type:     "tcp",
+				Interval: 10 * time.Second,
+				Timeout:  2 * time.Second,
+			},
+		},
+	})
+
+	args := []string{
+		"-listen", "/ip4/${NOMAD_IP_libp2p}/tcp/${NOMAD_PORT_libp2p}",
+		"-key", keyPath,
+	}
+	if _, ok := options["Args"]; ok {
+		if args, ok = options.StringSlice("Args"); !ok {
+			return nil, fmt.Errorf("Args must be a list of strings")
+		}
+	}
+
+	fetched, err := artifact.Resolve(deployment, options, "rendezvous")
+	if err != nil {
+		return nil, err
+	}
+	command, hasCommand := options.String("Command")
+	if image, ok := options.String("Image"); ok {
+		if fetched != nil {
+			return nil, fmt.Errorf("the Image option cannot be combined with fetched artifacts")
+		}
+		// The server announces the host's address, so it shares the host's
+		// network unless told otherwise.
+		hostNetwork := true
+		if set, ok := options.Bool("HostNetwork"); ok {
+			hostNetwork = set
+		}
+		utils.UseDocker(task, image, command, args, hostNetwork)
+		return task, nil
+	}
+	// No rendezvous server binary is installed by default, so it must be
+	// given by the Command, or fetched.
+	if fetched != nil {
+		task.Artifacts = []*napi.TaskArtifact{fetched}
+		if !hasCommand {
+			command = "rendezvous"
+		}
+	} else if !hasCommand {
+		return nil, fmt.Errorf("rendezvous servers require a Command, an Image or a fetched artifact")
+	}
+	task.SetConfig("command", command)
+	task.SetConfig("args", args)
+	return task, nil
+}
+
+// PostDeploy records the peer ID of every rendezvous server under its address,
+// in the run's KV namespace, as the p2pd plugin does for daemons. Peer IDs are
+// derived from the Identity option, so the servers are not contacted, but
+// their services must be registered.
+func (n *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
+	ids, err := p2pd.PeerIDs(deployment, options)
+	if err != nil {
+		return err
+	}
+	return p2pd.RecordIdentities(ctx, consul, deployment, ServiceName, ids)
+}
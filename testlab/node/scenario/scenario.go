@@ -1,25 +1,23 @@
 package scenario
 
 import (
+	"context"
 	"fmt"
-	"reflect"
-	"strings"
 
 	capi "github.com/hashicorp/consul/api"
 	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
 	"github.com/libp2p/testlab/utils"
 	"github.com/sirupsen/logrus"
 )
 
-type Node struct {
-	consulConfig *capi.Config
-}
+type Node struct{}
 
-func (s *Node) PostDeploy(consul *capi.Client, options utils.NodeOptions) error {
+func (s *Node) PostDeploy(ctx context.Context, consul *capi.Client, deployment *utils.DeploymentContext, options utils.NodeOptions) error {
 	return nil
 }
 
-func (s *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
+func (s *Node) Task(deployment *utils.DeploymentContext, options utils.NodeOptions) (*napi.Task, error) {
 	task := napi.NewTask("scenario", "exec")
 	task.Env = make(map[string]string)
 
@@ -46,20 +44,37 @@ func (s *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 	task.Require(res)
 
 	var command string
-	if url, ok := options.String("Fetch"); ok {
-		task.Artifacts = []*napi.TaskArtifact{
-			&napi.TaskArtifact{
-				GetterSource: utils.StringPtr(url),
-				RelativeDest: utils.StringPtr("scenario"),
-			},
+	fetched, err := artifact.Resolve(deployment, options, "scenario")
+	if err != nil {
+		return nil, err
+	}
+	image, docker := options.String("Image")
+	if docker {
+		if fetched != nil {
+			return nil, fmt.Errorf("the Image option cannot be combined with fetched artifacts")
 		}
+		// The image's entrypoint runs the scenario, unless overridden.
+		command, _ = options.String("Command")
+	} else if fetched != nil {
+		task.Artifacts = []*napi.TaskArtifact{fetched}
 		command = "scenario"
 	} else if cmd, ok := options.String("Command"); ok {
 		command = cmd
 	} else {
-		return nil, fmt.Errorf(`scenarios require a "Fetch" or "Command" option be set, found neither`)
+		return nil, fmt.Errorf(`scenarios require a "Build", "Path", "Fetch", "Cid" or "Command" option be set, found none`)
+	}
+	if docker {
+		// Daemons push streams to the addresses scenarios listen on, which
+		// must be reachable from the host, so scenarios share the host's
+		// network unless told otherwise.
+		hostNetwork := true
+		if set, ok := options.Bool("HostNetwork"); ok {
+			hostNetwork = set
+		}
+		utils.UseDocker(task, image, command, nil, hostNetwork)
+	} else {
+		task.SetConfig("command", command)
 	}
-	task.SetConfig("command", command)
 
 	if tag, ok := options.String("TargetTag"); ok {
 		task.Env["SERVICE_TAG"] = tag
@@ -67,28 +82,13 @@ func (s *Node) Task(options utils.NodeOptions) (*napi.Task, error) {
 		return nil, fmt.Errorf(`scenarios require a "TargetTag" option be set, found none`)
 	}
 
-	if env, ok := options.Object("Env"); ok {
+	if env, ok := options.StringMap("Env"); ok {
 		for k, v := range env {
-			vstr, ok := v.(string)
-			if !ok {
-				typ := reflect.TypeOf(v)
-				logrus.Warnf("expected Env key %s to be a string, got %s", k, typ.String())
-				continue
-			}
-			task.Env[k] = vstr
+			task.Env[k] = v
 		}
 	}
 
-	if s.consulConfig != nil {
-		envStrs := s.consulConfig.GenerateEnv()
-		for _, envStr := range envStrs {
-			parts := strings.SplitN(envStr, "=", 2)
-			if len(parts) != 2 {
-				continue
-			}
-			task.Env[parts[0]] = parts[1]
-		}
-	}
+	utils.AddClusterEnvToTask(task, deployment)
 
 	return task, nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/libp2p/testlab/testlab/node/external"
+	"github.com/urfave/cli"
+)
+
+func listPlugins(c *cli.Context) error {
+	plugins, err := testLab.Plugins()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSOURCE\tDESCRIPTION")
+	for _, plugin := range plugins {
+		if plugin.Path == "" {
+			fmt.Fprintf(w, "%s\tregistered\t\n", plugin.Name)
+			continue
+		}
+		description := ""
+		if ext, err := external.New(plugin.Path); err == nil {
+			description, err = ext.Description()
+			if err != nil {
+				description = fmt.Sprintf("error: %s", err)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", plugin.Name, plugin.Path, description)
+	}
+	return w.Flush()
+}
+
+var Plugins = cli.Command{
+	Name:        "plugins",
+	Description: "Inspect the node plugins available to topologies",
+	Subcommands: []cli.Command{
+		{
+			Name:        "list",
+			Description: "Lists registered plugins and external plugins found in the plugin path",
+			Action:      listPlugins,
+		},
+	},
+}
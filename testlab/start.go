@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/libp2p/testlab"
 	"github.com/sirupsen/logrus"
@@ -35,7 +38,43 @@ func start(c *cli.Context) error {
 		return err
 	}
 
-	return testLab.Start(topology)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigch)
+	go func() {
+		select {
+		case <-sigch:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err = testLab.Start(ctx, topology); err != nil {
+		return err
+	}
+
+	// With --watch, task events are recorded until interrupted, as with
+	// testlab events.
+	watch := c.Bool("watch")
+	watched := make(chan error, 1)
+	if watch {
+		go func() {
+			watched <- testLab.WatchEvents(ctx, logEvent)
+		}()
+	}
+	if err = testLab.InjectFaults(ctx, topology); err != nil {
+		return err
+	}
+	if err = testLab.ServeArtifacts(ctx); err != nil {
+		return err
+	}
+	if !watch {
+		return nil
+	}
+	logrus.Info("recording task events until interrupted")
+	return <-watched
 }
 
 var Start = cli.Command{
@@ -43,4 +82,10 @@ var Start = cli.Command{
 	Description: "Start a cluster with a given configuration",
 	Action:      start,
 	ArgsUsage:   "[testlab configuration]",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "watch",
+			Usage: "Record task events, as testlab events does, until interrupted",
+		},
+	},
 }
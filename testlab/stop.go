@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 
@@ -8,7 +9,7 @@ import (
 )
 
 func stop(c *cli.Context) {
-	if err := testLab.Clear(); err != nil {
+	if err := testLab.Clear(context.Background()); err != nil {
 		fmt.Fprintf(os.Stderr, "tearing down testlab %s", err)
 	}
 }
@@ -17,6 +17,8 @@ func main() {
 	app.Commands = []cli.Command{
 		Stop,
 		Start,
+		Plugins,
+		Events,
 	}
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
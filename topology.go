@@ -1,10 +1,18 @@
 package testlab
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 
 	capi "github.com/hashicorp/consul/api"
 	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/artifact"
+	"github.com/libp2p/testlab/chaos"
+	"github.com/libp2p/testlab/connectivity"
+	"github.com/libp2p/testlab/network"
 	"github.com/libp2p/testlab/testlab/node"
 	"github.com/libp2p/testlab/utils"
 )
@@ -17,31 +25,294 @@ type Deployment struct {
 	Options      utils.NodeOptions
 	Quantity     int
 	Dependencies []string
+	// Region overrides the topology's region for this deployment. Deployments
+	// in different regions are scheduled as separate nomad jobs.
+	Region string
+	// Datacenters overrides the topology's datacenters for this deployment,
+	// whose task groups are constrained to them.
+	Datacenters []string
+	// Distribution maps datacenters to weights. When set, Quantity is split
+	// across the datacenters proportionally to their weight, with one task
+	// group per datacenter.
+	Distribution map[string]float64
+	// Restart and Reschedule override nomad's policies for the deployment's
+	// failed tasks and allocations.
+	Restart    *RestartPolicy
+	Reschedule *ReschedulePolicy
 }
 
-func (d *Deployment) TaskGroup() (*napi.TaskGroup, node.PostDeployFunc, error) {
-	group := napi.NewTaskGroup(d.Name, d.Quantity)
-	group.Count = &d.Quantity
+// datacenterWeights returns the datacenters in the deployment's Distribution,
+// in lexical order, along with their weights.
+func (d *Deployment) datacenterWeights() ([]string, []float64, error) {
+	datacenters := make([]string, 0, len(d.Distribution))
+	for dc, weight := range d.Distribution {
+		if weight <= 0 {
+			return nil, nil, fmt.Errorf("deployment %s: distribution weight for %s must be positive, got %f", d.Name, dc, weight)
+		}
+		if len(d.Datacenters) > 0 && !utils.ContainsString(d.Datacenters, dc) {
+			return nil, nil, fmt.Errorf("deployment %s: distribution datacenter %s not in Datacenters", d.Name, dc)
+		}
+		datacenters = append(datacenters, dc)
+	}
+	sort.Strings(datacenters)
 
-	plugin, err := node.GetPlugin(d.Plugin)
+	weights := make([]float64, len(datacenters))
+	for i, dc := range datacenters {
+		weights[i] = d.Distribution[dc]
+	}
+	return datacenters, weights, nil
+}
+
+// apportion splits quantity into integer shares proportional to the given
+// positive weights, using the largest remainder method.
+func apportion(quantity int, weights []float64) []int {
+	total := 0.0
+	for _, weight := range weights {
+		total += weight
+	}
+	quantities := make([]int, len(weights))
+	remainders := make([]float64, len(weights))
+	assigned := 0
+	for i, weight := range weights {
+		share := float64(quantity) * weight / total
+		quantities[i] = int(math.Floor(share))
+		remainders[i] = share - math.Floor(share)
+		assigned += quantities[i]
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for i := 0; assigned < quantity; i++ {
+		quantities[order[i%len(order)]]++
+		assigned++
+	}
+	return quantities
+}
+
+// Sidecar adds the tasks generated by a plugin to the task groups of other
+// deployments.
+type Sidecar struct {
+	// Name prefixes the names of the sidecar's tasks.
+	Name    string
+	Plugin  string
+	Options utils.NodeOptions
+	// Deployments lists the deployments the sidecar is added to. If empty, it
+	// is added to all of them.
+	Deployments []string
+
+	plugin node.Node
+}
+
+func (s *Sidecar) appliesTo(deployment string) bool {
+	return len(s.Deployments) == 0 || utils.ContainsString(s.Deployments, deployment)
+}
+
+// Extras are the tasks a topology adds to a deployment's task groups, next to
+// those generated by the deployment's plugin.
+type Extras struct {
+	// Links originating from the deployment, and partitions if enabled, are
+	// applied by a network sidecar.
+	Links      []*network.Link
+	Partitions bool
+	// Disk lists the deployments disk faults can be injected into, which get
+	// a disk sidecar.
+	Disk []string
+	// Sidecars applying to the deployment add their tasks to each group.
+	Sidecars []*Sidecar
+}
+
+// TaskGroups generates the nomad task groups for this deployment, along with
+// the datacenters they should be scheduled in. Without a Distribution, a
+// single task group is generated, constrained to the deployment's Datacenters
+// if set, otherwise there is one per datacenter, constrained to run there.
+// Plugins splitting deployments into variants get a task group per variant,
+// within each datacenter.
+func (d *Deployment) TaskGroups(plugin node.Node, deploymentCtx *utils.DeploymentContext, datacenters []string, extras *Extras) ([]*napi.TaskGroup, []string, node.PostDeployFunc, error) {
+	if len(d.Datacenters) > 0 {
+		datacenters = d.Datacenters
+	}
+
+	postDeploy := func(ctx context.Context, c *capi.Client) error {
+		if err := plugin.PostDeploy(ctx, c, deploymentCtx, d.Options); err != nil {
+			return err
+		}
+		for _, sidecar := range extras.Sidecars {
+			if !sidecar.appliesTo(d.Name) {
+				continue
+			}
+			if err := sidecar.plugin.PostDeploy(ctx, c, deploymentCtx, sidecar.Options); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	variants := []*node.Variant{{Weight: 1, Options: d.Options}}
+	if splitter, ok := plugin.(node.Splitter); ok {
+		vs, err := splitter.Variants(d.Options)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("deployment %s: %s", d.Name, err)
+		}
+		if len(vs) > 0 {
+			variants = vs
+		}
+	}
+	weights := make([]float64, len(variants))
+	for i, variant := range variants {
+		if variant.Weight <= 0 {
+			return nil, nil, nil, fmt.Errorf("deployment %s: weight of variant %s must be positive, got %f", d.Name, variant.Name, variant.Weight)
+		}
+		weights[i] = variant.Weight
+	}
+
+	dcs, dcWeights := []string{""}, []float64{1}
+	if len(d.Distribution) > 0 {
+		var err error
+		if dcs, dcWeights, err = d.datacenterWeights(); err != nil {
+			return nil, nil, nil, err
+		}
+		datacenters = dcs
+	}
+
+	// Quantity is split across variants first, so that their shares of the
+	// whole deployment are as close as possible to their weights, and then
+	// each variant's share is split across datacenters, using the largest
+	// remainder method so that the counts always sum to Quantity.
+	quantities := make([][]int, len(variants))
+	for v, quantity := range apportion(d.Quantity, weights) {
+		quantities[v] = apportion(quantity, dcWeights)
+	}
+
+	var groups []*napi.TaskGroup
+	offset := 0
+	for i, dc := range dcs {
+		for v := range variants {
+			quantity := quantities[v][i]
+			if quantity == 0 {
+				continue
+			}
+			name := d.Name
+			if dc != "" {
+				name = fmt.Sprintf("%s_%s", name, dc)
+			}
+			if variants[v].Name != "" {
+				name = fmt.Sprintf("%s_%s", name, variants[v].Name)
+			}
+			group, err := d.taskGroup(plugin, deploymentCtx, name, variants[v].Options, offset, quantity, extras)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if dc != "" {
+				group.Constrain(napi.NewConstraint("${node.datacenter}", "=", dc))
+			} else if len(d.Datacenters) > 0 {
+				// The job's datacenters are those of all its deployments.
+				group.Constrain(napi.NewConstraint("${node.datacenter}", "set_contains_any", strings.Join(d.Datacenters, ",")))
+			}
+			groups = append(groups, group)
+			offset += quantity
+		}
+	}
+	return groups, datacenters, postDeploy, nil
+}
+
+// taskGroup generates a task group of quantity instances of the deployment,
+// the first of which is the deployment's offset-th instance, with the given
+// plugin options.
+func (d *Deployment) taskGroup(plugin node.Node, deploymentCtx *utils.DeploymentContext, name string, options utils.NodeOptions, offset, quantity int, extras *Extras) (*napi.TaskGroup, error) {
+	groupCtx := *deploymentCtx
+	groupCtx.Offset = offset
+	groupCtx.Count = quantity
+	deploymentCtx = &groupCtx
+
+	group := napi.NewTaskGroup(name, quantity)
+	group.Count = &quantity
+	group.SetMeta(utils.DeploymentMetaKey, d.Name)
+	if d.Restart != nil {
+		policy, err := d.Restart.nomad()
+		if err != nil {
+			return nil, fmt.Errorf("deployment %s: %s", d.Name, err)
+		}
+		group.RestartPolicy = policy
+	}
+	if d.Reschedule != nil {
+		policy, err := d.Reschedule.nomad()
+		if err != nil {
+			return nil, fmt.Errorf("deployment %s: %s", d.Name, err)
+		}
+		group.ReschedulePolicy = policy
+	}
+
+	tasks, err := node.Tasks(plugin, deploymentCtx, options)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	main := tasks[0]
+	group.SetMeta(utils.TaskMetaKey, main.Name)
+
+	for _, sidecar := range extras.Sidecars {
+		if !sidecar.appliesTo(d.Name) {
+			continue
+		}
+		sidecarTasks, err := node.Tasks(sidecar.plugin, deploymentCtx, sidecar.Options)
+		if err != nil {
+			return nil, fmt.Errorf("sidecar %s: %s", sidecar.Name, err)
+		}
+		for _, task := range sidecarTasks {
+			if len(sidecarTasks) == 1 {
+				task.Name = sidecar.Name
+			} else {
+				task.Name = fmt.Sprintf("%s-%s", sidecar.Name, task.Name)
+			}
+			tasks = append(tasks, task)
+		}
 	}
-	task, err := plugin.Task(d.Options)
+
+	networkTask, err := network.Task(deploymentCtx.RunID, d.Name, main, extras.Links, extras.Partitions)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
+	}
+	if networkTask != nil {
+		tasks = append(tasks, networkTask)
 	}
-	group.AddTask(task)
-	postDeploy := func(c *capi.Client) error {
-		return plugin.PostDeploy(c, d.Options)
+	if utils.ContainsString(extras.Disk, d.Name) {
+		tasks = append(tasks, chaos.DiskTask())
 	}
-	return group, postDeploy, nil
+
+	tag := utils.DeploymentTag(deploymentCtx.RunID, d.Name)
+	names := make(map[string]struct{}, len(tasks))
+	for _, task := range tasks {
+		if _, ok := names[task.Name]; ok {
+			return nil, fmt.Errorf("deployment %s has more than one task named %s", d.Name, task.Name)
+		}
+		names[task.Name] = struct{}{}
+		for _, svc := range task.Services {
+			svc.Name = deploymentCtx.ServiceName(svc.Name)
+			svc.Tags = append(append([]string{}, svc.Tags...), tag)
+		}
+		group.AddTask(task)
+	}
+	return group, nil
 }
 
 type TopologyOptions struct {
 	Region      string
 	Priority    int
 	Datacenters []string
+	// Partitions adds a network sidecar to every deployment exposing a libp2p
+	// service, so that it can be partitioned from the rest of the network.
+	// It is implied by partition faults.
+	Partitions bool
+	// DiskFaults lists deployments to add a disk sidecar to, so that disk
+	// faults can be injected into them, e.g. by scenarios. It is implied by
+	// disk faults.
+	DiskFaults []string
+	// Artifacts configures where the plugins' artifacts are fetched from, and
+	// testlab's artifact server.
+	Artifacts *artifact.Options
 }
 
 type Topology struct {
@@ -51,6 +322,30 @@ type Topology struct {
 	// Deployments details the different node types to schedule on the nomad
 	// cluster.
 	Deployments []*Deployment
+	// Links describes the network conditions between deployments.
+	Links []*network.Link
+	// Faults are injected into the deployments once the topology is running.
+	Faults []*chaos.Fault
+	// Sidecars add tasks to the task groups of deployments.
+	Sidecars []*Sidecar
+	// Connectivity is the graph peers are connected into once every phase is
+	// deployed.
+	Connectivity *connectivity.Spec
+}
+
+// connectivityDeployments returns the deployments whose peers make up the
+// connectivity graph: those listed by the spec, or every p2pd deployment.
+func (t *Topology) connectivityDeployments() []string {
+	if len(t.Connectivity.Deployments) > 0 {
+		return t.Connectivity.Deployments
+	}
+	var names []string
+	for _, deployment := range t.Deployments {
+		if deployment.Plugin == "p2pd" {
+			names = append(names, deployment.Name)
+		}
+	}
+	return names
 }
 
 func (t *Topology) Phases() ([][]*Deployment, error) {
@@ -86,8 +381,55 @@ func (t *Topology) Phases() ([][]*Deployment, error) {
 	return phases, nil
 }
 
-func (t *Topology) Jobs() ([]*napi.Job, [][]node.PostDeployFunc, error) {
+// Environment describes where, and as part of which run, a topology is
+// deployed.
+type Environment struct {
+	// RunID uniquely identifies this run of the topology.
+	RunID  string
+	Consul *capi.Config
+	Nomad  *napi.Config
+	// Registry resolves the plugins of the topology's deployments.
+	Registry *node.Registry
+	// PluginPath lists the directories searched for external plugins.
+	PluginPath []string
+	// Artifacts describes where the plugins' artifacts are fetched from.
+	Artifacts *utils.ArtifactConfig
+}
+
+// context builds the context passed to the plugin of the given deployment.
+func (t *Topology) context(env *Environment, deployment *Deployment) *utils.DeploymentContext {
+	deploymentCtx := &utils.DeploymentContext{
+		Topology:   t.Name,
+		Deployment: deployment.Name,
+		Quantity:   deployment.Quantity,
+		RunID:      env.RunID,
+		Consul:     env.Consul,
+		Nomad:      env.Nomad,
+		Artifacts:  env.Artifacts,
+	}
+	for _, name := range deployment.Dependencies {
+		for _, dep := range t.Deployments {
+			if dep.Name != name {
+				continue
+			}
+			deploymentCtx.Dependencies = append(deploymentCtx.Dependencies, &utils.DependencyContext{
+				Name:     dep.Name,
+				Plugin:   dep.Plugin,
+				Quantity: dep.Quantity,
+				Options:  dep.Options,
+			})
+		}
+	}
+	return deploymentCtx
+}
+
+// Jobs translates the topology into nomad jobs, one per region in each phase,
+// along with the post deploy hooks to run once each phase is scheduled.
+func (t *Topology) Jobs(env *Environment) ([][]*napi.Job, [][]node.PostDeployFunc, error) {
 	opts := t.Options
+	if opts == nil {
+		opts = &TopologyOptions{}
+	}
 	region := opts.Region
 	if opts.Region == "" {
 		region = "global"
@@ -101,24 +443,154 @@ func (t *Topology) Jobs() ([]*napi.Job, [][]node.PostDeployFunc, error) {
 		return nil, nil, err
 	}
 
-	jobs := make([]*napi.Job, len(phases))
+	names := make([]string, len(t.Deployments))
+	for i, deployment := range t.Deployments {
+		names[i] = deployment.Name
+	}
+	for _, link := range t.Links {
+		if !utils.ContainsString(names, link.From) || !utils.ContainsString(names, link.To) {
+			return nil, nil, fmt.Errorf("network link %s -> %s references an unknown deployment", link.From, link.To)
+		}
+	}
+	partitions := opts.Partitions
+	disk := append([]string{}, opts.DiskFaults...)
+	for _, name := range disk {
+		if !utils.ContainsString(names, name) {
+			return nil, nil, fmt.Errorf("disk faults enabled for unknown deployment %s", name)
+		}
+	}
+	for _, fault := range t.Faults {
+		if err := fault.Validate(); err != nil {
+			return nil, nil, err
+		}
+		if fault.Type == chaos.Partition {
+			partitions = true
+			continue
+		}
+		if !utils.ContainsString(names, fault.Deployment) {
+			return nil, nil, fmt.Errorf("%s fault references unknown deployment %s", fault.Type, fault.Deployment)
+		}
+		if fault.Type == chaos.Disk && !utils.ContainsString(disk, fault.Deployment) {
+			disk = append(disk, fault.Deployment)
+		}
+	}
+
+	if opts.Artifacts != nil {
+		if err := opts.Artifacts.Validate(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.Connectivity != nil {
+		if err := t.Connectivity.Validate(); err != nil {
+			return nil, nil, err
+		}
+		for _, name := range t.Connectivity.Deployments {
+			if !utils.ContainsString(names, name) {
+				return nil, nil, fmt.Errorf("connectivity references unknown deployment %s", name)
+			}
+		}
+		if len(t.connectivityDeployments()) == 0 {
+			return nil, nil, fmt.Errorf("connectivity requires deployments exposing a p2pd service")
+		}
+	}
+
+	for _, sidecar := range t.Sidecars {
+		if sidecar.Name == "" {
+			return nil, nil, fmt.Errorf("sidecars require a Name")
+		}
+		for _, name := range sidecar.Deployments {
+			if !utils.ContainsString(names, name) {
+				return nil, nil, fmt.Errorf("sidecar %s references unknown deployment %s", sidecar.Name, name)
+			}
+		}
+		sidecar.plugin, err = env.Registry.Resolve(sidecar.Plugin, env.PluginPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("sidecar %s: %s", sidecar.Name, err)
+		}
+	}
+	extras := &Extras{
+		Links:      t.Links,
+		Partitions: partitions,
+		Disk:       disk,
+		Sidecars:   t.Sidecars,
+	}
+
+	// Deployments registering a libp2p service, which partitions resolve
+	// deployments through.
+	partitionable := make(map[string]bool)
+	jobs := make([][]*napi.Job, len(phases))
 	postDeployFuncs := make([][]node.PostDeployFunc, len(phases))
 	for i, phase := range phases {
 		phasePostDeployFuncs := make([]node.PostDeployFunc, len(phase))
-		name := fmt.Sprintf("%s_phase_%d", t.Name, i)
-		job := napi.NewServiceJob(name, name, region, opts.Priority)
-		job.Datacenters = opts.Datacenters
+		regionJobs := make(map[string]*napi.Job)
+		var phaseJobs []*napi.Job
 		for e, deployment := range phase {
-			group, postDeploy, err := deployment.TaskGroup()
+			plugin, err := env.Registry.Resolve(deployment.Plugin, env.PluginPath)
+			if err != nil {
+				return nil, nil, err
+			}
+			deploymentCtx := t.context(env, deployment)
+			groups, datacenters, postDeploy, err := deployment.TaskGroups(plugin, deploymentCtx, opts.Datacenters, extras)
 			if err != nil {
 				return nil, nil, err
 			}
-			job.AddTaskGroup(group)
+
+			jobRegion := region
+			if deployment.Region != "" {
+				jobRegion = deployment.Region
+			}
+			job, ok := regionJobs[jobRegion]
+			if !ok {
+				name := fmt.Sprintf("%s_phase_%d", t.Name, i)
+				if jobRegion != region {
+					name = fmt.Sprintf("%s_%s", name, jobRegion)
+				}
+				job = napi.NewServiceJob(name, name, jobRegion, opts.Priority)
+				regionJobs[jobRegion] = job
+				phaseJobs = append(phaseJobs, job)
+			}
+			for _, dc := range datacenters {
+				if !utils.ContainsString(job.Datacenters, dc) {
+					job.Datacenters = append(job.Datacenters, dc)
+				}
+			}
+			for _, group := range groups {
+				for _, task := range group.Tasks {
+					if task.Env == nil {
+						task.Env = make(map[string]string)
+					}
+					task.Env[utils.TopologyEnvName] = t.Name
+					task.Env[utils.DeploymentEnvName] = deployment.Name
+					task.Env[utils.RunIDEnvName] = env.RunID
+					for _, svc := range task.Services {
+						if svc.Name == deploymentCtx.ServiceName(network.LibP2PServiceName) {
+							partitionable[deployment.Name] = true
+						}
+					}
+				}
+				job.AddTaskGroup(group)
+			}
 			phasePostDeployFuncs[e] = postDeploy
 		}
-		jobs[i] = job
+		jobs[i] = phaseJobs
 		postDeployFuncs[i] = phasePostDeployFuncs
 	}
 
+	// Fail before deploying rather than when the fault is injected. Island
+	// members that are not deployment names are peer IDs.
+	for _, fault := range t.Faults {
+		if fault.Type != chaos.Partition {
+			continue
+		}
+		for _, island := range fault.Islands {
+			for _, member := range island {
+				if utils.ContainsString(names, member) && !partitionable[member] {
+					return nil, nil, fmt.Errorf("partition fault isolates deployment %s, which registers no %s service; p2pd daemons only register it with the Undialable or NAT option", member, network.LibP2PServiceName)
+				}
+			}
+		}
+	}
+
 	return jobs, postDeployFuncs, nil
 }
@@ -0,0 +1,144 @@
+package testlab
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+	"github.com/libp2p/testlab/testlab/node"
+	"github.com/libp2p/testlab/utils"
+)
+
+func TestApportion(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		quantity int
+		weights  []float64
+		expected []int
+	}{
+		{"single", 7, []float64{1}, []int{7}},
+		{"even", 9, []float64{1, 1, 1}, []int{3, 3, 3}},
+		{"largest remainder", 10, []float64{1, 1, 1}, []int{4, 3, 3}},
+		{"proportional", 10, []float64{0.7, 0.3}, []int{7, 3}},
+		{"unnormalized", 5, []float64{3, 1}, []int{4, 1}},
+		{"ties favour first", 10, []float64{0.55, 0.45}, []int{6, 4}},
+		{"zero", 0, []float64{1, 2}, []int{0, 0}},
+		{"fewer than weights", 2, []float64{1, 1, 1}, []int{1, 1, 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := apportion(tc.quantity, tc.weights)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("apportion(%d, %v) = %v, expected %v", tc.quantity, tc.weights, got, tc.expected)
+			}
+			sum := 0
+			for _, q := range got {
+				sum += q
+			}
+			if sum != tc.quantity {
+				t.Fatalf("apportion(%d, %v) sums to %d", tc.quantity, tc.weights, sum)
+			}
+		})
+	}
+}
+
+// testNode is a plugin generating a single task, split into the given
+// variants if any.
+type testNode struct {
+	variants []*node.Variant
+}
+
+func (n *testNode) Task(*utils.DeploymentContext, utils.NodeOptions) (*napi.Task, error) {
+	return napi.NewTask("test", "exec"), nil
+}
+
+func (n *testNode) PostDeploy(context.Context, *capi.Client, *utils.DeploymentContext, utils.NodeOptions) error {
+	return nil
+}
+
+func (n *testNode) Variants(utils.NodeOptions) ([]*node.Variant, error) {
+	return n.variants, nil
+}
+
+func TestTaskGroups(t *testing.T) {
+	type group struct {
+		name       string
+		count      int
+		constraint string
+	}
+	variants := []*node.Variant{
+		{Name: "a", Weight: 0.7},
+		{Name: "b", Weight: 0.3},
+	}
+	for _, tc := range []struct {
+		name        string
+		deployment  *Deployment
+		variants    []*node.Variant
+		datacenters []string
+		groups      []group
+	}{
+		{
+			name:        "whole",
+			deployment:  &Deployment{Name: "peers", Quantity: 5},
+			datacenters: []string{"dc1"},
+			groups:      []group{{"peers", 5, ""}},
+		},
+		{
+			name:        "datacenters",
+			deployment:  &Deployment{Name: "peers", Quantity: 5, Datacenters: []string{"dc2", "dc3"}},
+			datacenters: []string{"dc2", "dc3"},
+			groups:      []group{{"peers", 5, "set_contains_any dc2,dc3"}},
+		},
+		{
+			name:        "distribution",
+			deployment:  &Deployment{Name: "peers", Quantity: 10, Distribution: map[string]float64{"dc2": 1, "dc1": 3}},
+			datacenters: []string{"dc1", "dc2"},
+			groups:      []group{{"peers_dc1", 8, "= dc1"}, {"peers_dc2", 2, "= dc2"}},
+		},
+		{
+			name:        "variants",
+			deployment:  &Deployment{Name: "peers", Quantity: 10},
+			variants:    variants,
+			datacenters: []string{"dc1"},
+			groups:      []group{{"peers_a", 7, ""}, {"peers_b", 3, ""}},
+		},
+		{
+			// Variants are apportioned deployment-wide, so b gets 3 of 10
+			// instances rather than 1 of 5 in each datacenter.
+			name:        "variants across datacenters",
+			deployment:  &Deployment{Name: "peers", Quantity: 10, Distribution: map[string]float64{"dc1": 1, "dc2": 1}},
+			variants:    variants,
+			datacenters: []string{"dc1", "dc2"},
+			groups: []group{
+				{"peers_dc1_a", 4, "= dc1"},
+				{"peers_dc1_b", 2, "= dc1"},
+				{"peers_dc2_a", 3, "= dc2"},
+				{"peers_dc2_b", 1, "= dc2"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := &utils.DeploymentContext{Deployment: tc.deployment.Name, Quantity: tc.deployment.Quantity, RunID: "run"}
+			groups, datacenters, _, err := tc.deployment.TaskGroups(&testNode{tc.variants}, ctx, []string{"dc1"}, &Extras{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(datacenters, tc.datacenters) {
+				t.Fatalf("expected datacenters %v, got %v", tc.datacenters, datacenters)
+			}
+			got := make([]group, len(groups))
+			for i, g := range groups {
+				got[i] = group{name: *g.Name, count: *g.Count}
+				for _, c := range g.Constraints {
+					if c.LTarget == "${node.datacenter}" {
+						got[i].constraint = c.Operand + " " + c.RTarget
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tc.groups) {
+				t.Fatalf("expected groups %v, got %v", tc.groups, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/libp2p/go-libp2p-daemon/p2pclient"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// WithDaemonClient calls fn with a client of the daemon listening on the given
+// control address, closing the client once fn returns. The client's own
+// listener, which testlab never uses, is bound to a socket in a temporary
+// directory.
+func WithDaemonClient(controlAddr string, fn func(*p2pclient.Client) error) error {
+	addr, err := ma.NewMultiaddr(controlAddr)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir(os.TempDir(), "daemon_client")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	listenAddr, err := ma.NewMultiaddr(filepath.Join("/unix", dir, "ignore.sock"))
+	if err != nil {
+		return err
+	}
+	client, err := p2pclient.NewClient(addr, listenAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return fn(client)
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+	napi "github.com/hashicorp/nomad/api"
+)
+
+// DeploymentContext describes the cluster and deployment a plugin is called
+// for.
+type DeploymentContext struct {
+	// Topology is the name of the topology being deployed.
+	Topology string
+	// Deployment is the name of the deployment.
+	Deployment string
+	// Quantity is the number of instances of the deployment.
+	Quantity int
+	// RunID uniquely identifies this run of the topology.
+	RunID string
+	// Consul is the configuration testlab uses to reach consul.
+	Consul *capi.Config `json:"-"`
+	// Nomad is the configuration testlab uses to reach nomad.
+	Nomad *napi.Config `json:"-"`
+	// Dependencies are the deployments this deployment depends on.
+	Dependencies []*DependencyContext
+	// Offset and Count describe the task group tasks are being generated for:
+	// the index, among the deployment's instances, of the group's first
+	// instance, and the number of instances in the group. Instance i of the
+	// deployment runs with NOMAD_ALLOC_INDEX i - Offset in its group.
+	Offset int `json:",omitempty"`
+	Count  int `json:",omitempty"`
+	// Artifacts configures where the artifacts plugins fetch come from, see
+	// the artifact package.
+	Artifacts *ArtifactConfig `json:",omitempty"`
+}
+
+// ArtifactConfig describes where the artifacts of a run are fetched from.
+type ArtifactConfig struct {
+	// Gateway is the IPFS gateway nomad clients fetch CIDs from.
+	Gateway string `json:",omitempty"`
+	// IPFSAPI is the address of the IPFS API testlab fetches CIDs through.
+	IPFSAPI string `json:",omitempty"`
+	// ServerURL is the URL nomad clients reach testlab's artifact server at,
+	// empty if it is not running.
+	ServerURL string `json:",omitempty"`
+	// Dir is the directory served by the artifact server.
+	Dir string `json:",omitempty"`
+}
+
+// DependencyContext describes a deployment another deployment depends on.
+type DependencyContext struct {
+	Name     string
+	Plugin   string
+	Quantity int
+	Options  NodeOptions
+}
+
+// Dependency looks up one of the deployment's dependencies by name.
+func (c *DeploymentContext) Dependency(name string) (*DependencyContext, bool) {
+	for _, dep := range c.Dependencies {
+		if dep.Name == name {
+			return dep, true
+		}
+	}
+	return nil, false
+}
+
+// Key returns the consul KV key of the given path within the namespace of the
+// deployment's run.
+func (c *DeploymentContext) Key(elem ...string) string {
+	return RunKey(c.RunID, elem...)
+}
+
+// ServiceName returns the name the named service of the deployment's run is
+// registered under in consul.
+func (c *DeploymentContext) ServiceName(service string) string {
+	return ServiceName(c.RunID, service)
+}
+
+// KVPrefix is the consul KV prefix under which the data of every run is
+// stored, each run under its own ID.
+const KVPrefix = "testlab"
+
+// RunKey returns the consul KV key of the given path within the namespace of
+// the given run, i.e. testlab/<run id>/<path>.
+func RunKey(runID string, elem ...string) string {
+	return path.Join(append([]string{KVPrefix, runID}, elem...)...)
+}
+
+var runIDInvalidChars = regexp.MustCompile(`[^a-z0-9\-]+`)
+
+// NewRunID generates an identifier for a new run of the named topology,
+// consisting of lowercase alpha-numeric characters and dashes. The start time
+// is followed by random characters, so that runs of the same topology started
+// within the same second, e.g. by CI jobs sharing a cluster, do not collide.
+func NewRunID(topology string) string {
+	name := runIDInvalidChars.ReplaceAllString(strings.ToLower(topology), "-")
+	now := time.Now()
+	var nonce [4]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		binary.BigEndian.PutUint32(nonce[:], uint32(now.UnixNano()))
+	}
+	return fmt.Sprintf("%s-%s-%x", strings.Trim(name, "-"), strconv.FormatInt(now.Unix(), 36), nonce)
+}
+
+// ConsulEnv returns the environment variables needed to reach consul with the
+// given configuration.
+func ConsulEnv(config *capi.Config) map[string]string {
+	env := make(map[string]string)
+	if config == nil {
+		return env
+	}
+	for _, envStr := range config.GenerateEnv() {
+		parts := strings.SplitN(envStr, "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			continue
+		}
+		env[parts[0]] = parts[1]
+	}
+	return env
+}
+
+// NomadEnv returns the environment variables needed to reach nomad with the
+// given configuration.
+func NomadEnv(config *napi.Config) map[string]string {
+	env := make(map[string]string)
+	if config == nil {
+		return env
+	}
+	set := func(key, value string) {
+		if value != "" {
+			env[key] = value
+		}
+	}
+	set("NOMAD_ADDR", config.Address)
+	set("NOMAD_REGION", config.Region)
+	set("NOMAD_NAMESPACE", config.Namespace)
+	set("NOMAD_TOKEN", config.SecretID)
+	if tls := config.TLSConfig; tls != nil {
+		set("NOMAD_CACERT", tls.CACert)
+		set("NOMAD_CAPATH", tls.CAPath)
+		set("NOMAD_CLIENT_CERT", tls.ClientCert)
+		set("NOMAD_CLIENT_KEY", tls.ClientKey)
+		set("NOMAD_TLS_SERVER_NAME", tls.TLSServerName)
+		if tls.Insecure {
+			set("NOMAD_SKIP_VERIFY", "true")
+		}
+	}
+	return env
+}
+
+// AddClusterEnvToTask adds the environment variables needed to reach the
+// deployment's consul and nomad clusters to the given task's environment.
+func AddClusterEnvToTask(t *napi.Task, c *DeploymentContext) {
+	if t.Env == nil {
+		t.Env = make(map[string]string)
+	}
+	for k, v := range ConsulEnv(c.Consul) {
+		t.Env[k] = v
+	}
+	for k, v := range NomadEnv(c.Nomad) {
+		t.Env[k] = v
+	}
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	napi "github.com/hashicorp/nomad/api"
+)
+
+// dockerPortBase is the first container port UseDocker maps dynamic ports to.
+const dockerPortBase = 10000
+
+// UseDocker switches the task to the docker driver, running the given image
+// with the given command, if not empty, and arguments. Unless hostNetwork is
+// set, the container gets its own network, and each dynamic port of the task
+// is mapped to a container port: within the container, NOMAD_PORT_<label>
+// holds the container port, and NOMAD_HOST_PORT_<label> the port on the host.
+// The task's resources must be set beforehand.
+func UseDocker(task *napi.Task, image, command string, args []string, hostNetwork bool) {
+	task.Driver = "docker"
+	task.Config = map[string]interface{}{"image": image}
+	if command != "" {
+		task.SetConfig("command", command)
+	}
+	if len(args) > 0 {
+		task.SetConfig("args", args)
+	}
+	if hostNetwork {
+		task.SetConfig("network_mode", "host")
+		return
+	}
+	portMap := make(map[string]interface{})
+	if task.Resources != nil {
+		port := dockerPortBase
+		for _, network := range task.Resources.Networks {
+			for _, p := range network.DynamicPorts {
+				portMap[p.Label] = port
+				port++
+			}
+		}
+	}
+	if len(portMap) > 0 {
+		task.SetConfig("port_map", []interface{}{portMap})
+	}
+}
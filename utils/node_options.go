@@ -1,5 +1,11 @@
 package utils
 
+import (
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
 type NodeOptions map[string]interface{}
 
 func (opts NodeOptions) String(key string) (string, bool) {
@@ -48,8 +54,15 @@ func (opts NodeOptions) Object(key string) (NodeOptions, bool) {
 		return nil, ok
 	}
 
-	obj, ok := opt.(NodeOptions)
-	return obj, ok
+	switch obj := opt.(type) {
+	case NodeOptions:
+		return obj, true
+	case map[string]interface{}:
+		// Objects decoded from JSON are plain maps.
+		return NodeOptions(obj), true
+	default:
+		return nil, false
+	}
 }
 
 func (opts NodeOptions) Slice(key string) ([]interface{}, bool) {
@@ -79,3 +92,56 @@ func (opts NodeOptions) StringSlice(key string) ([]string, bool) {
 
 	return stringSlice, true
 }
+
+func (opts NodeOptions) ObjectSlice(key string) ([]NodeOptions, bool) {
+	slice, ok := opts.Slice(key)
+	if !ok {
+		return nil, ok
+	}
+
+	objects := make([]NodeOptions, len(slice))
+	for i, item := range slice {
+		switch obj := item.(type) {
+		case NodeOptions:
+			objects[i] = obj
+		case map[string]interface{}:
+			objects[i] = NodeOptions(obj)
+		default:
+			return nil, false
+		}
+	}
+
+	return objects, true
+}
+
+// StringMap returns the object under the given key as a map of strings, e.g.
+// the environment variables of a task. Values that are not strings are
+// skipped with a warning.
+func (opts NodeOptions) StringMap(key string) (map[string]string, bool) {
+	obj, ok := opts.Object(key)
+	if !ok {
+		return nil, ok
+	}
+
+	strs := make(map[string]string, len(obj))
+	for k, v := range obj {
+		str, ok := v.(string)
+		if !ok {
+			logrus.Warnf("expected %s key %s to be a string, got %s", key, k, reflect.TypeOf(v))
+			continue
+		}
+		strs[k] = str
+	}
+
+	return strs, true
+}
+
+// ContainsString reports whether the list contains the given string.
+func ContainsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Backoff describes how an operation is retried.
+type Backoff struct {
+	// Attempts is the maximum number of times the operation is tried.
+	Attempts int
+	// Initial is the delay before the first retry, doubled on every
+	// subsequent one.
+	Initial time.Duration
+	// Max caps the delay between retries.
+	Max time.Duration
+}
+
+// DefaultBackoff tries an operation up to 5 times over roughly 15 seconds.
+var DefaultBackoff = Backoff{
+	Attempts: 5,
+	Initial:  time.Second,
+	Max:      8 * time.Second,
+}
+
+// Retry calls fn until it succeeds, the attempts are exhausted or the context
+// is cancelled, returning the last error.
+func Retry(ctx context.Context, b Backoff, fn func() error) error {
+	delay := b.Initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt >= b.Attempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+		if b.Max > 0 && delay > b.Max {
+			delay = b.Max
+		}
+	}
+}
+
+// InstanceErrors maps the instances an operation failed for to their errors.
+type InstanceErrors map[string]error
+
+func (e InstanceErrors) Error() string {
+	instances := make([]string, 0, len(e))
+	for instance := range e {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	msgs := make([]string, len(instances))
+	for i, instance := range instances {
+		msgs[i] = fmt.Sprintf("%s: %s", instance, e[instance])
+	}
+	return fmt.Sprintf("%d instances failed: %s", len(e), strings.Join(msgs, "; "))
+}
+
+// ForEach calls fn for each of the given instances, running at most
+// parallelism calls at once. Every instance is attempted, even if some fail,
+// and the failures are returned as InstanceErrors.
+func ForEach(ctx context.Context, parallelism int, instances []string, fn func(context.Context, string) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := semaphore.NewWeighted(int64(parallelism))
+	var (
+		wg   sync.WaitGroup
+		lk   sync.Mutex
+		errs = make(InstanceErrors)
+	)
+	for _, instance := range instances {
+		if err := sem.Acquire(ctx, 1); err != nil {
+			lk.Lock()
+			errs[instance] = err
+			lk.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(instance string) {
+			defer wg.Done()
+			defer sem.Release(1)
+			if err := fn(ctx, instance); err != nil {
+				lk.Lock()
+				errs[instance] = err
+				lk.Unlock()
+			}
+		}(instance)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
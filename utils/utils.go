@@ -2,11 +2,9 @@ package utils
 
 import (
 	"fmt"
-	"os"
 	"regexp"
 
 	capi "github.com/hashicorp/consul/api"
-	napi "github.com/hashicorp/nomad/api"
 	ma "github.com/multiformats/go-multiaddr"
 )
 
@@ -19,30 +17,6 @@ func StringPtr(str string) *string {
 // and dashes
 var ValidTaskNameRegexp = regexp.MustCompile(`(?i)^[A-Za-z0-9\-]+$`)
 
-var consulEnvNames = []string{
-	capi.GRPCAddrEnvName,
-	capi.HTTPAddrEnvName,
-	capi.HTTPAuthEnvName,
-	capi.HTTPSSLEnvName,
-	capi.HTTPSSLVerifyEnvName,
-	capi.HTTPTokenEnvName,
-	capi.HTTPCAFile,
-	capi.HTTPCAPath,
-	capi.HTTPClientCert,
-	capi.HTTPClientKey,
-	capi.HTTPTLSServerName,
-}
-
-// AddConsulEnvToTask inspects the environment for consul-related variables,
-// adding any found to the given task's environment
-func AddConsulEnvToTask(t *napi.Task) {
-	for _, envVar := range consulEnvNames {
-		if envVal, ok := os.LookupEnv(envVar); ok {
-			t.Env[envVar] = envVal
-		}
-	}
-}
-
 func PeerControlAddrs(consul *capi.Client, service, tag string) ([]ma.Multiaddr, error) {
 	svcs, _, err := consul.Catalog().Service(service, tag, nil)
 	if err != nil {
@@ -61,3 +35,39 @@ func PeerControlAddrs(consul *capi.Client, service, tag string) ([]ma.Multiaddr,
 
 	return maddrs, nil
 }
+
+// DeploymentTag is the tag applied to every consul service registered by a
+// deployment in the given run, so that its services can be found by
+// deployment name.
+func DeploymentTag(runID, deployment string) string {
+	return fmt.Sprintf("testlab-deployment-%s-%s", runID, deployment)
+}
+
+// ServiceName qualifies the name of a consul service registered in the given
+// run, so that runs sharing a cluster do not discover each other's services.
+// Service names are qualified automatically when a topology is deployed, but
+// lookups must use the qualified name.
+func ServiceName(runID, service string) string {
+	return fmt.Sprintf("%s-%s", runID, service)
+}
+
+// DeploymentMetaKey is the task group meta key holding the name of the
+// deployment the group belongs to.
+const DeploymentMetaKey = "testlab_deployment"
+
+// TaskMetaKey is the task group meta key holding the name of the group's main
+// task, the first task generated by the deployment's plugin, which faults are
+// injected into.
+const TaskMetaKey = "testlab_task"
+
+const (
+	// TopologyEnvName is the environment variable holding the name of the
+	// topology a task belongs to.
+	TopologyEnvName = "TESTLAB_TOPOLOGY"
+	// DeploymentEnvName is the environment variable holding the name of the
+	// deployment a task belongs to.
+	DeploymentEnvName = "TESTLAB_DEPLOYMENT"
+	// RunIDEnvName is the environment variable holding the ID of the run a
+	// task belongs to.
+	RunIDEnvName = "TESTLAB_RUN_ID"
+)